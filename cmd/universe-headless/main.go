@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"git.c3pb.de/farhaven/universe/config"
+	"git.c3pb.de/farhaven/universe/headless"
+	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/profile"
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func main() {
+	opts := headless.Options{}
+	prof := profile.Options{}
+	prof.RegisterFlags(flag.CommandLine)
+
+	load := flag.String("load", "", "initial snapshot to load")
+	flag.Uint64Var(&opts.Ticks, "ticks", 0, "number of ticks to simulate")
+	flag.Float64Var(&opts.Time, "time", 0, "amount of simulated time to run for")
+	flag.Uint64Var(&opts.SnapshotInterval, "snapshot-every", 0, "write a snapshot every N ticks")
+	flag.StringVar(&opts.SnapshotPattern, "snapshot", "", "snapshot file name, %d is replaced by the tick, .bin selects the binary format and .gz compresses")
+	flag.StringVar(&opts.DiagnosticsFile, "diagnostics", "", "CSV file to write the conserved quantities to")
+	failOnDrift := flag.Bool("fail-on-drift", false, "exit with an error if the conserved quantities drift beyond the drift threshold")
+
+	cfg, printConfig, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf(`can't parse configuration: %s`, err)
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	ocfg, err := cfg.Orrery()
+	if err != nil {
+		log.Fatalf(`invalid configuration: %s`, err)
+	}
+	if *failOnDrift {
+		opts.MaxDrift = cfg.DriftThreshold
+	}
+	gen, err := cfg.Generator()
+	if err != nil {
+		log.Fatalf(`invalid configuration: %s`, err)
+	}
+
+	stopProfiling, err := prof.Start()
+	if err != nil {
+		log.Fatalf(`can't start profiling: %s`, err)
+	}
+
+	o := orrery.New(ocfg)
+
+	if *load != "" {
+		err = o.LoadSnapshot(*load)
+		if err != nil {
+			log.Fatalf(`can't read initial snapshot: %s`, err)
+		}
+	}
+
+	if gen != nil {
+		err = o.Generate(gen, cfg.ICSeed, vector.V3{}, vector.V3{})
+		if err != nil {
+			log.Fatalf(`can't generate initial conditions: %s`, err)
+		}
+	}
+
+	if cfg.Record != "" {
+		err = o.StartRecording(cfg.Record, cfg.RecordInterval)
+		if err != nil {
+			log.Fatalf(`can't start recording: %s`, err)
+		}
+	}
+
+	err = headless.Run(o, opts)
+	stopProfiling()
+	if err := o.Close(); err != nil {
+		log.Printf(`can't finish recording: %s`, err)
+	}
+	if err != nil {
+		log.Printf(`headless run failed: %s`, err)
+		os.Exit(1)
+	}
+}
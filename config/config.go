@@ -0,0 +1,426 @@
+// Package config holds the configuration of the universe binaries. It is
+// read from an optional JSON file and can be overridden with command line
+// flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"git.c3pb.de/farhaven/universe/orrery"
+)
+
+// Duration is a time.Duration that is written as a string like "5ms" in
+// config files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// BlockLeapfrog holds the parameters of the block time step integrator.
+type BlockLeapfrog struct {
+	Eta      float64
+	Length   float64
+	MaxLevel int
+}
+
+type Config struct {
+	Width  int
+	Height int
+	Font   string
+
+	Universe    string // file loaded and stored with K and Shift+K in the GUI
+	Slots       string // directory of the save slots
+	TrailLength int
+	LoopTime    Duration
+	Seed        int64
+	Workers     int // gravity workers, 0 for GOMAXPROCS
+
+	// A unit system other than "" sets G to its value in that system:
+	// simulation, si, solar or galactic. It takes precedence over G from a
+	// config file, and can't be combined with -G on the command line.
+	Units         string
+	G             float64
+	Epsilon       float64 // softening length, 0 to disable
+	Softening     string  // plummer or spline
+	Gravity       string  // pairwise or barnes-hut
+	Theta         float64
+	Integrator    string // euler, leapfrog, verlet, rk4 or block-leapfrog
+	BlockLeapfrog BlockLeapfrog
+	Dt            float64
+
+	Collisions  string // bounce, merge or pass
+	Restitution float64
+
+	DiagnosticsInterval int
+	DriftThreshold      float64
+
+	Record         string // trajectory file, .csv or .ndjson, empty to disable
+	RecordInterval int
+
+	RewindLength   int // number of frames in the rewind buffer, 0 to disable
+	RewindInterval int
+
+	// Initial conditions added at the start: plummer, disc, binaries,
+	// solar-system or empty for none. ICCount is the number of particles,
+	// or of planets for solar-system, 0 picks the default of the initial
+	// conditions. An ICSeed of 0 uses the simulation seed.
+	IC      string
+	ICCount int
+	ICMass  float64
+	ICSeed  int64
+}
+
+func Default() Config {
+	o := orrery.DefaultConfig()
+
+	return Config{
+		Width:  1024,
+		Height: 768,
+		Font:   "font.ttf",
+
+		Universe:    o.Universe,
+		Slots:       "saves",
+		TrailLength: o.TrailLength,
+		LoopTime:    Duration(o.LoopTime),
+		Seed:        o.Seed,
+		Workers:     o.Workers,
+
+		G:          o.G,
+		Epsilon:    o.Epsilon,
+		Softening:  o.Softening.String(),
+		Gravity:    "pairwise",
+		Theta:      0.5,
+		Integrator: "leapfrog",
+		BlockLeapfrog: BlockLeapfrog{
+			Eta:      0.05,
+			Length:   1,
+			MaxLevel: 8,
+		},
+		Dt: o.Dt,
+
+		Collisions:  o.Collisions.String(),
+		Restitution: o.Restitution,
+
+		DiagnosticsInterval: o.DiagnosticsInterval,
+		DriftThreshold:      o.DriftThreshold,
+
+		RecordInterval: 10,
+
+		RewindLength:   o.RewindLength,
+		RewindInterval: o.RewindInterval,
+
+		ICMass: 1000,
+	}
+}
+
+// RegisterFlags adds flags for all settings to fs. Their defaults are the
+// current values of c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Width, "width", c.Width, "window width")
+	fs.IntVar(&c.Height, "height", c.Height, "window height")
+	fs.StringVar(&c.Font, "font", c.Font, "path to the HUD font")
+
+	fs.StringVar(&c.Universe, "universe", c.Universe, "file to load and store the universe from and to with K and Shift+K in the GUI")
+	fs.StringVar(&c.Slots, "slots", c.Slots, "directory of the save slots")
+	fs.IntVar(&c.TrailLength, "trail-length", c.TrailLength, "number of trail points per particle")
+	fs.Var(&c.LoopTime, "loop-time", "wall-clock time per simulation loop iteration")
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "seed of the random number generator, 0 picks a random one")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of goroutines computing gravity, 0 for one per CPU")
+
+	fs.StringVar(&c.Units, "units", c.Units, "unit system that sets G instead of -G: simulation, si, solar or galactic")
+	fs.Float64Var(&c.G, "G", c.G, "gravitational constant")
+	fs.Float64Var(&c.Epsilon, "epsilon", c.Epsilon, "softening length of gravity, 0 to disable")
+	fs.StringVar(&c.Softening, "softening", c.Softening, "softening kernel: plummer or spline")
+	fs.StringVar(&c.Gravity, "gravity", c.Gravity, "gravity solver: pairwise or barnes-hut")
+	fs.Float64Var(&c.Theta, "theta", c.Theta, "opening angle of the barnes-hut solver")
+	fs.StringVar(&c.Integrator, "integrator", c.Integrator, "integrator: euler, leapfrog, verlet, rk4 or block-leapfrog")
+	fs.Float64Var(&c.BlockLeapfrog.Eta, "block-eta", c.BlockLeapfrog.Eta, "accuracy parameter of the block-leapfrog integrator")
+	fs.Float64Var(&c.BlockLeapfrog.Length, "block-length", c.BlockLeapfrog.Length, "length scale of the block-leapfrog integrator")
+	fs.IntVar(&c.BlockLeapfrog.MaxLevel, "block-max-level", c.BlockLeapfrog.MaxLevel, "maximum number of step halvings of the block-leapfrog integrator")
+	fs.Float64Var(&c.Dt, "dt", c.Dt, "simulated time per tick")
+
+	fs.StringVar(&c.Collisions, "collisions", c.Collisions, "collision policy: bounce, merge or pass")
+	fs.Float64Var(&c.Restitution, "restitution", c.Restitution, "coefficient of restitution for bouncing collisions")
+
+	fs.IntVar(&c.DiagnosticsInterval, "diagnostics-interval", c.DiagnosticsInterval, "record conserved quantities every N ticks, 0 to disable")
+	fs.Float64Var(&c.DriftThreshold, "drift-threshold", c.DriftThreshold, "relative drift of conserved quantities that triggers a warning")
+
+	fs.StringVar(&c.Record, "record", c.Record, "record particle trajectories to this .csv or .ndjson file")
+	fs.IntVar(&c.RecordInterval, "record-every", c.RecordInterval, "record trajectories every N ticks")
+
+	fs.IntVar(&c.RewindLength, "rewind-length", c.RewindLength, "number of frames kept for rewinding, 0 to disable")
+	fs.IntVar(&c.RewindInterval, "rewind-every", c.RewindInterval, "keep a rewind frame every N ticks")
+
+	fs.StringVar(&c.IC, "ic", c.IC, "initial conditions: plummer, disc, binaries or solar-system")
+	fs.IntVar(&c.ICCount, "ic-count", c.ICCount, "number of particles of the initial conditions, or planets for solar-system, 0 for the default")
+	fs.Float64Var(&c.ICMass, "ic-mass", c.ICMass, "total mass of the initial conditions, or the sun's mass for solar-system")
+	fs.Int64Var(&c.ICSeed, "ic-seed", c.ICSeed, "seed for the initial conditions, 0 uses -seed")
+}
+
+// Load reads the settings in the JSON file fname into c. Settings that are
+// not in the file keep their current value.
+func (c *Config) Load(fname string) error {
+	fh, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	d := json.NewDecoder(fh)
+	d.DisallowUnknownFields()
+	err = d.Decode(c)
+	if err != nil {
+		return fmt.Errorf(`can't parse %s: %s`, fname, err)
+	}
+
+	return nil
+}
+
+// Print writes c to w in the format of the config file.
+func (c Config) Print(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// Orrery returns the orrery configuration described by c.
+func (c Config) Orrery() (orrery.Config, error) {
+	o := orrery.DefaultConfig()
+
+	switch c.Gravity {
+	case "pairwise":
+		o.Gravity = orrery.Pairwise{}
+	case "barnes-hut":
+		o.Gravity = orrery.BarnesHut{Theta: c.Theta}
+	default:
+		return o, fmt.Errorf(`unknown gravity solver %q`, c.Gravity)
+	}
+
+	switch c.Integrator {
+	case "euler":
+		o.Integrator = orrery.Euler{}
+	case "leapfrog":
+		o.Integrator = orrery.Leapfrog{}
+	case "verlet":
+		o.Integrator = orrery.VelocityVerlet{}
+	case "rk4":
+		o.Integrator = orrery.RK4{}
+	case "block-leapfrog":
+		b := c.BlockLeapfrog
+		if !(b.Eta > 0) {
+			return o, fmt.Errorf(`block-leapfrog accuracy must be positive, got %f`, b.Eta)
+		}
+		if !(b.Length > 0) {
+			return o, fmt.Errorf(`block-leapfrog length scale must be positive, got %f`, b.Length)
+		}
+		if b.MaxLevel < 0 || b.MaxLevel > 30 {
+			return o, fmt.Errorf(`block-leapfrog maximum level must be between 0 and 30, got %d`, b.MaxLevel)
+		}
+		o.Integrator = orrery.BlockLeapfrog{
+			Eta:      c.BlockLeapfrog.Eta,
+			Length:   c.BlockLeapfrog.Length,
+			MaxLevel: c.BlockLeapfrog.MaxLevel,
+		}
+	default:
+		return o, fmt.Errorf(`unknown integrator %q`, c.Integrator)
+	}
+
+	switch c.Collisions {
+	case orrery.COLLIDE_BOUNCE.String():
+		o.Collisions = orrery.COLLIDE_BOUNCE
+	case orrery.COLLIDE_MERGE.String():
+		o.Collisions = orrery.COLLIDE_MERGE
+	case orrery.COLLIDE_PASS.String():
+		o.Collisions = orrery.COLLIDE_PASS
+	default:
+		return o, fmt.Errorf(`unknown collision policy %q`, c.Collisions)
+	}
+
+	switch c.Softening {
+	case orrery.SOFTEN_PLUMMER.String():
+		o.Softening = orrery.SOFTEN_PLUMMER
+	case orrery.SOFTEN_SPLINE.String():
+		o.Softening = orrery.SOFTEN_SPLINE
+	default:
+		return o, fmt.Errorf(`unknown softening kernel %q`, c.Softening)
+	}
+
+	g, err := c.resolveG()
+	if err != nil {
+		return o, err
+	}
+	o.G = g
+
+	if !(o.G > 0) {
+		return o, fmt.Errorf(`gravitational constant must be positive, got %f`, o.G)
+	}
+	if c.Epsilon < 0 {
+		return o, fmt.Errorf(`softening length must not be negative, got %f`, c.Epsilon)
+	}
+	if c.Dt <= 0 {
+		return o, fmt.Errorf(`dt must be positive, got %f`, c.Dt)
+	}
+	if c.LoopTime <= 0 {
+		return o, fmt.Errorf(`loop time must be positive, got %s`, c.LoopTime)
+	}
+	if c.Record != "" && c.RecordInterval < 1 {
+		return o, fmt.Errorf(`record interval must be positive, got %d`, c.RecordInterval)
+	}
+	if c.RewindLength > 0 && c.RewindInterval < 1 {
+		return o, fmt.Errorf(`rewind interval must be positive, got %d`, c.RewindInterval)
+	}
+	if c.Restitution < 0 || c.Restitution > 1 {
+		return o, fmt.Errorf(`coefficient of restitution must be between 0 and 1, got %f`, c.Restitution)
+	}
+	if c.Workers < 0 {
+		return o, fmt.Errorf(`number of workers must not be negative, got %d`, c.Workers)
+	}
+	if c.TrailLength < 0 {
+		return o, fmt.Errorf(`trail length must not be negative, got %d`, c.TrailLength)
+	}
+
+	o.Epsilon = c.Epsilon
+	o.Dt = c.Dt
+	o.LoopTime = time.Duration(c.LoopTime)
+	o.Restitution = c.Restitution
+	o.TrailLength = c.TrailLength
+	o.Universe = c.Universe
+	o.Seed = c.Seed
+	o.Workers = c.Workers
+	o.DiagnosticsInterval = c.DiagnosticsInterval
+	o.DriftThreshold = c.DriftThreshold
+	o.RewindLength = c.RewindLength
+	o.RewindInterval = c.RewindInterval
+
+	return o, nil
+}
+
+// Generator returns the generator for the initial conditions, or nil if
+// there are none.
+func (c Config) Generator() (orrery.Generator, error) {
+	n := c.ICCount
+	if n == 0 {
+		n = 100
+	}
+
+	switch c.IC {
+	case "":
+		return nil, nil
+	case "plummer":
+		return orrery.Plummer{N: n, Mass: c.ICMass, Radius: 100}, nil
+	case "disc":
+		return orrery.Disc{N: n, Mass: c.ICMass, CentralMass: c.ICMass, ScaleLength: 50, ScaleHeight: 2}, nil
+	case "binaries":
+		return orrery.Binaries{N: n, Mass: c.ICMass, Separation: 200, Ratio: 0.1}, nil
+	case "solar-system":
+		if c.ICCount == 0 {
+			n = 8
+		}
+		return orrery.SolarSystem{Planets: n, Mass: c.ICMass, AU: 40}, nil
+	}
+	return nil, fmt.Errorf(`unknown initial conditions %q`, c.IC)
+}
+
+// resolveG returns the gravitational constant of the unit system, or G if
+// none is set.
+func (c Config) resolveG() (float64, error) {
+	if c.Units == "" {
+		return c.G, nil
+	}
+
+	for _, u := range orrery.UnitSystems {
+		if u.Name == c.Units {
+			return u.G, nil
+		}
+	}
+	return 0, fmt.Errorf(`unknown unit system %q`, c.Units)
+}
+
+// Parse parses args with fs, after adding the flags for all settings and
+// the -config and -print-config flags. Settings are taken from the
+// defaults, then from the config file, then from the command line. G is
+// set from the unit system if there is one, so that the printed
+// configuration is the effective one.
+func Parse(fs *flag.FlagSet, args []string) (cfg Config, printConfig bool, err error) {
+	cfg = Default()
+	cfg.RegisterFlags(fs)
+
+	fname := fs.String("config", "", "JSON config file")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+
+	err = fs.Parse(args)
+	if err != nil {
+		return cfg, false, err
+	}
+
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	_, units := set["units"]
+	_, g := set["G"]
+	if units && g {
+		return cfg, false, errors.New(`-units and -G can't be used together`)
+	}
+
+	if *fname != "" {
+		err = cfg.Load(*fname)
+		if err != nil {
+			return cfg, false, err
+		}
+
+		// Flags given on the command line take precedence over the file
+		for name, value := range set {
+			err = fs.Set(name, value)
+			if err != nil {
+				return cfg, false, err
+			}
+		}
+
+		if g && !units {
+			// An explicit G replaces the unit system of the file
+			cfg.Units = ""
+		}
+	}
+
+	cfg.G, err = cfg.resolveG()
+	if err != nil {
+		return cfg, false, err
+	}
+
+	return cfg, printConfig, nil
+}
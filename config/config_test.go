@@ -0,0 +1,212 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestParse(t *testing.T) {
+	fh, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+
+	_, err = fh.WriteString(`{"G": 2, "Gravity": "barnes-hut", "LoopTime": "10ms", "Dt": 0.5}`)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err := Parse(fs, []string{"-dt", "0.25", "-config", fh.Name(), "-integrator", "rk4"})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+
+	o, err := cfg.Orrery()
+	if err != nil {
+		t.Fatalf(`invalid config: %s`, err)
+	}
+
+	if o.G != 2 {
+		t.Errorf(`expected G from file, got %f`, o.G)
+	}
+	if o.LoopTime != 10*time.Millisecond {
+		t.Errorf(`expected loop time from file, got %s`, o.LoopTime)
+	}
+	if _, ok := o.Gravity.(orrery.BarnesHut); !ok {
+		t.Errorf(`expected barnes-hut from file, got %T`, o.Gravity)
+	}
+	if o.Dt != 0.25 {
+		t.Errorf(`expected dt from the command line to override the file, got %f`, o.Dt)
+	}
+	if _, ok := o.Integrator.(orrery.RK4); !ok {
+		t.Errorf(`expected rk4 from the command line, got %T`, o.Integrator)
+	}
+	if o.TrailLength != 20 {
+		t.Errorf(`expected default trail length, got %d`, o.TrailLength)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	cfg := Default()
+	cfg.Integrator = "magic"
+
+	_, err := cfg.Orrery()
+	if err == nil {
+		t.Errorf(`expected an error for an unknown integrator`)
+	}
+
+	for _, r := range []float64{-0.1, 1.5} {
+		cfg := Default()
+		cfg.Restitution = r
+		if _, err := cfg.Orrery(); err == nil {
+			t.Errorf(`expected an error for restitution %f`, r)
+		}
+	}
+
+	for _, g := range []float64{0, -1, math.NaN()} {
+		cfg := Default()
+		cfg.G = g
+		if _, err := cfg.Orrery(); err == nil {
+			t.Errorf(`expected an error for G %f`, g)
+		}
+	}
+
+	for _, b := range []BlockLeapfrog{
+		{Eta: 0, Length: 1, MaxLevel: 10},
+		{Eta: 0.1, Length: -1, MaxLevel: 10},
+		{Eta: 0.1, Length: math.NaN(), MaxLevel: 10},
+		{Eta: 0.1, Length: 1, MaxLevel: -1},
+		{Eta: 0.1, Length: 1, MaxLevel: 63},
+	} {
+		cfg := Default()
+		cfg.Integrator = "block-leapfrog"
+		cfg.BlockLeapfrog = b
+		if _, err := cfg.Orrery(); err == nil {
+			t.Errorf(`expected an error for block-leapfrog parameters %+v`, b)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err := Parse(fs, []string{"-units", "solar", "-softening", "spline", "-epsilon", "0.1"})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+
+	// The printed configuration shows the effective G
+	if cfg.G != orrery.UNITS_SOLAR.G {
+		t.Errorf(`expected G of the solar unit system after parsing, got %f`, cfg.G)
+	}
+
+	o, err := cfg.Orrery()
+	if err != nil {
+		t.Fatalf(`invalid config: %s`, err)
+	}
+	if o.G != orrery.UNITS_SOLAR.G {
+		t.Errorf(`expected G of the solar unit system, got %f`, o.G)
+	}
+	if o.Softening != orrery.SOFTEN_SPLINE || o.Epsilon != 0.1 {
+		t.Errorf(`expected spline softening with epsilon 0.1, got %s with %f`, o.Softening, o.Epsilon)
+	}
+
+	cfg.Units = "furlongs"
+	if _, err := cfg.Orrery(); err == nil {
+		t.Errorf(`expected an error for an unknown unit system`)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	if _, _, err := Parse(fs, []string{"-units", "solar", "-G", "3"}); err == nil {
+		t.Errorf(`expected an error for -units together with -G`)
+	}
+
+	// An explicit G replaces the unit system of a config file
+	fh, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	_, err = fh.WriteString(`{"Units": "galactic"}`)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err = Parse(fs, []string{"-config", fh.Name(), "-G", "3"})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+	if cfg.G != 3 || cfg.Units != "" {
+		t.Errorf(`expected G 3 without units, got %f in %q`, cfg.G, cfg.Units)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err = Parse(fs, []string{"-config", fh.Name()})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+	if cfg.G != orrery.UNITS_GALACTIC.G {
+		t.Errorf(`expected G of the galactic unit system, got %f`, cfg.G)
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err := Parse(fs, []string{"-ic", "solar-system", "-ic-count", "4"})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+
+	g, err := cfg.Generator()
+	if err != nil {
+		t.Fatalf(`invalid config: %s`, err)
+	}
+	if s, ok := g.(orrery.SolarSystem); !ok || s.Planets != 4 {
+		t.Errorf(`expected a solar system with 4 planets, got %#v`, g)
+	}
+
+	// Without a count, the solar system has all of its planets
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, _, err = Parse(fs, []string{"-ic", "solar-system"})
+	if err != nil {
+		t.Fatalf(`can't parse: %s`, err)
+	}
+	g, err = cfg.Generator()
+	if err != nil {
+		t.Fatalf(`invalid config: %s`, err)
+	}
+	if s, ok := g.(orrery.SolarSystem); !ok || s.Planets != 8 {
+		t.Errorf(`expected a solar system with 8 planets, got %#v`, g)
+	}
+	oc, err := cfg.Orrery()
+	if err != nil {
+		t.Fatalf(`invalid config: %s`, err)
+	}
+	o := orrery.New(oc)
+	defer o.Close()
+	if err := o.Generate(g, 1, vector.V3{}, vector.V3{}); err != nil {
+		t.Errorf(`can't generate the default solar system: %s`, err)
+	}
+
+	cfg.IC = "plummer"
+	if g, _ := cfg.Generator(); g.(orrery.Plummer).N != 100 {
+		t.Errorf(`expected a default of 100 particles, got %#v`, g)
+	}
+
+	cfg.IC = "teapot"
+	if _, err := cfg.Generator(); err == nil {
+		t.Errorf(`expected an error for unknown initial conditions`)
+	}
+}
@@ -0,0 +1,198 @@
+// Package headless runs an orrery without any user interface, for batch
+// runs on machines without a display.
+package headless
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.c3pb.de/farhaven/universe/orrery"
+)
+
+type Options struct {
+	// The run stops after Ticks ticks or Time simulated time, whichever
+	// comes first. At least one of them has to be set. Both are counted
+	// from the state the orrery is in when the run starts.
+	Ticks uint64
+	Time  float64
+
+	// A snapshot is written every SnapshotInterval ticks, and at the end of
+	// the run. SnapshotPattern is the file name of the snapshots, with a
+	// single %d verb that is replaced by the tick. Its extension selects the
+	// snapshot format, see orrery.SaveSnapshot. No snapshots are written if
+	// SnapshotPattern is empty.
+	SnapshotInterval uint64
+	SnapshotPattern  string
+
+	// The diagnostics samples taken during the run are written to
+	// DiagnosticsFile as CSV, if it is set. If MaxDrift is positive, the
+	// run fails if any conserved quantity drifted further than that. It
+	// still runs to the end, so that the snapshots are written.
+	DiagnosticsFile string
+	MaxDrift        float64
+}
+
+func (opts Options) done(o *orrery.Orrery, ticks uint64, time float64) bool {
+	if opts.Ticks != 0 && o.Ticks()-ticks >= opts.Ticks {
+		return true
+	}
+	// The time may be off by a rounding error, so the run stops once less
+	// than half a tick is left
+	if opts.Time != 0 && opts.Time-(o.Time()-time) < o.Dt()/2 {
+		return true
+	}
+	return false
+}
+
+// checkPattern makes sure that pattern has exactly one integer verb for the
+// tick, so that every snapshot gets its own file name with the extension
+// at the end. Flags and a width, as in %06d, are allowed.
+func checkPattern(pattern string) error {
+	verbs := 0
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			continue
+		}
+
+		i++
+		for i < len(pattern) && strings.IndexByte("+-# 0123456789", pattern[i]) >= 0 {
+			i++
+		}
+		if i == len(pattern) {
+			return fmt.Errorf(`snapshot pattern %q ends in an incomplete verb`, pattern)
+		}
+		if pattern[i] == '%' {
+			continue
+		}
+		if strings.IndexByte("dboxX", pattern[i]) < 0 {
+			return fmt.Errorf(`snapshot pattern %q has verb %%%c, expected an integer verb like %%d`, pattern, pattern[i])
+		}
+		verbs++
+	}
+
+	if verbs != 1 {
+		return fmt.Errorf(`snapshot pattern %q needs exactly one %%d for the tick, got %d verbs`, pattern, verbs)
+	}
+	return nil
+}
+
+func writeSnapshot(o *orrery.Orrery, pattern string) error {
+	return o.SaveSnapshot(fmt.Sprintf(pattern, o.Ticks()))
+}
+
+// diagnosticsHeader holds the columns of diagnostics files.
+var diagnosticsHeader = []string{
+	"tick", "time", "n", "mass", "kinetic", "potential", "energy",
+	"px", "py", "pz", "lx", "ly", "lz",
+	"energy_drift", "momentum_drift", "angular_momentum_drift",
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeDiagnostics(w *csv.Writer, d orrery.Diagnostics) error {
+	return w.Write([]string{
+		strconv.FormatUint(d.Tick, 10),
+		formatFloat(d.Time),
+		strconv.Itoa(d.N),
+		formatFloat(d.Mass),
+		formatFloat(d.Kinetic),
+		formatFloat(d.Potential),
+		formatFloat(d.Energy()),
+		formatFloat(d.Momentum.X), formatFloat(d.Momentum.Y), formatFloat(d.Momentum.Z),
+		formatFloat(d.AngularMomentum.X), formatFloat(d.AngularMomentum.Y), formatFloat(d.AngularMomentum.Z),
+		formatFloat(d.EnergyDrift),
+		formatFloat(d.MomentumDrift),
+		formatFloat(d.AngularMomentumDrift),
+	})
+}
+
+// Run simulates o until the limits in opts are reached.
+func Run(o *orrery.Orrery, opts Options) (err error) {
+	if opts.Ticks == 0 && opts.Time == 0 {
+		return errors.New(`neither a tick nor a time limit is set`)
+	}
+	if opts.SnapshotPattern != "" {
+		err := checkPattern(opts.SnapshotPattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	var diagnostics *csv.Writer
+	if opts.DiagnosticsFile != "" {
+		fh, ferr := os.Create(opts.DiagnosticsFile)
+		if ferr != nil {
+			return ferr
+		}
+		diagnostics = csv.NewWriter(fh)
+		defer func() {
+			diagnostics.Flush()
+			if ferr := diagnostics.Error(); ferr != nil && err == nil {
+				err = ferr
+			}
+			if ferr := fh.Close(); ferr != nil && err == nil {
+				err = ferr
+			}
+		}()
+
+		err = diagnostics.Write(diagnosticsHeader)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Samples are handled as they are taken, as the orrery only keeps a
+	// limited number of them
+	var drift error
+	ticks, time := o.Ticks(), o.Time()
+	sampled := ticks
+	for !opts.done(o, ticks, time) {
+		o.Step(1)
+
+		if d, ok := o.LastDiagnostics(); ok && d.Tick > sampled {
+			sampled = d.Tick
+			if diagnostics != nil {
+				err := writeDiagnostics(diagnostics, d)
+				if err != nil {
+					return err
+				}
+			}
+			if drift == nil && opts.MaxDrift > 0 && math.Max(d.EnergyDrift, math.Max(d.MomentumDrift, d.AngularMomentumDrift)) > opts.MaxDrift {
+				drift = fmt.Errorf(`tick %d: conserved quantities drifted beyond %g: energy %g, momentum %g, angular momentum %g`,
+					d.Tick, opts.MaxDrift, d.EnergyDrift, d.MomentumDrift, d.AngularMomentumDrift)
+			}
+		}
+
+		if opts.SnapshotPattern != "" && opts.SnapshotInterval != 0 && o.Ticks()%opts.SnapshotInterval == 0 {
+			err := writeSnapshot(o, opts.SnapshotPattern)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.SnapshotPattern != "" && (opts.SnapshotInterval == 0 || o.Ticks()%opts.SnapshotInterval != 0) {
+		err := writeSnapshot(o, opts.SnapshotPattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf(`simulated %d ticks, t=%f`, o.Ticks(), o.Time())
+
+	d := o.Diagnostics()
+	log.Printf(`energy %g (kinetic %g, potential %g), momentum %s, angular momentum %s`,
+		d.Energy(), d.Kinetic, d.Potential, d.Momentum, d.AngularMomentum)
+	log.Printf(`drift: energy %g, momentum %g, angular momentum %g`,
+		d.EnergyDrift, d.MomentumDrift, d.AngularMomentumDrift)
+
+	return drift
+}
@@ -0,0 +1,153 @@
+package headless
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := orrery.New(orrery.DefaultConfig())
+	defer o.Close()
+	opts := Options{
+		Ticks:            25,
+		SnapshotInterval: 10,
+		SnapshotPattern:  filepath.Join(dir, "snap-%d.json"),
+	}
+
+	err = Run(o, opts)
+	if err != nil {
+		t.Fatalf(`run failed: %s`, err)
+	}
+
+	if n := o.Ticks(); n != 25 {
+		t.Errorf(`expected 25 ticks, got %d`, n)
+	}
+
+	for _, f := range []string{"snap-10.json", "snap-20.json", "snap-25.json"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf(`expected snapshot %s: %s`, f, err)
+		}
+	}
+}
+
+func TestRunTime(t *testing.T) {
+	cfg := orrery.DefaultConfig()
+	cfg.Dt = 0.1
+	o := orrery.New(cfg)
+	defer o.Close()
+
+	// Ten steps of 0.1 don't add up to exactly 1
+	err := Run(o, Options{Time: 1})
+	if err != nil {
+		t.Fatalf(`run failed: %s`, err)
+	}
+	if n := o.Ticks(); n != 10 || o.Time() != 1 {
+		t.Errorf(`expected 10 ticks to t=1, got %d to t=%v`, n, o.Time())
+	}
+
+	// Also not when starting from a time other than 0
+	o.Step(3)
+	err = Run(o, Options{Time: 0.7})
+	if err != nil {
+		t.Fatalf(`run failed: %s`, err)
+	}
+	if n := o.Ticks(); n != 20 {
+		t.Errorf(`expected 7 more ticks, got %d`, n-13)
+	}
+}
+
+func TestRunDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := orrery.DefaultConfig()
+	cfg.DiagnosticsInterval = 10
+	o := orrery.New(cfg)
+	defer o.Close()
+	o.QueueCommand(orrery.CommandSpawnParticle{M: 1000}).Wait()
+	o.QueueCommand(orrery.CommandSpawnOrbit{Parent: 1, Pos: vector.V3{X: 50}, M: 1}).Wait()
+
+	// Every sample is written, and the run goes on after drifting too far
+	fname := filepath.Join(dir, "diagnostics.csv")
+	err = Run(o, Options{Ticks: 50, DiagnosticsFile: fname, MaxDrift: 1e-300})
+	if err == nil {
+		t.Errorf(`expected an error for drifting too far`)
+	}
+	if n := o.Ticks(); n != 50 {
+		t.Errorf(`expected 50 ticks, got %d`, n)
+	}
+
+	fh, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	rows, err := csv.NewReader(fh).ReadAll()
+	if err != nil {
+		t.Fatalf(`can't read diagnostics: %s`, err)
+	}
+	if len(rows) != 6 || rows[1][0] != "10" || rows[5][0] != "50" || rows[5][2] != "2" {
+		t.Errorf(`expected samples of 2 particles at ticks 10 to 50, got %v`, rows)
+	}
+
+	err = Run(o, Options{Ticks: 50, MaxDrift: 0.1})
+	if err != nil {
+		t.Errorf(`unexpected error: %s`, err)
+	}
+}
+
+func TestCheckPattern(t *testing.T) {
+	for pattern, ok := range map[string]bool{
+		"snap-%d.json":        true,
+		"snap-%06d.bin.gz":    true,
+		"100%%-%d.json":       true,
+		"snap.json":           false,
+		"snap-%d-%d.json":     false,
+		"snap-%s.json":        false,
+		"snap-%d.json%":       false,
+		"snap-%%d.json":       false,
+		"%d/snap-%v.json":     false,
+		"snap-%[1]d.json":     false,
+		"snap-%d-%%%d.json":   false,
+		"snap-%x-of-it%.json": false,
+	} {
+		err := checkPattern(pattern)
+		if ok && err != nil {
+			t.Errorf(`%s: unexpected error %s`, pattern, err)
+		}
+		if !ok && err == nil {
+			t.Errorf(`%s: expected an error`, pattern)
+		}
+	}
+
+	o := orrery.New(orrery.DefaultConfig())
+	defer o.Close()
+	err := Run(o, Options{Ticks: 1, SnapshotPattern: "snap.json"})
+	if err == nil {
+		t.Errorf(`expected an error for a pattern without %%d`)
+	}
+}
+
+func TestRunWithoutLimit(t *testing.T) {
+	o := orrery.New(orrery.DefaultConfig())
+	defer o.Close()
+	err := Run(o, Options{})
+	if err == nil {
+		t.Errorf(`expected an error without tick or time limit`)
+	}
+}
@@ -0,0 +1,247 @@
+package orrery
+
+import (
+	"log"
+	"math"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// Number of diagnostics samples kept by an orrery
+const maxDiagnosticsHistory = 10000
+
+// Diagnostics holds the conserved quantities of the system at one point in
+// time, as well as how far they drifted since the reference sample.
+type Diagnostics struct {
+	Tick uint64
+	Time float64
+
+	N    int
+	Mass float64
+
+	Kinetic         float64
+	Potential       float64
+	Momentum        vector.V3
+	AngularMomentum vector.V3 // around the origin
+	CentreOfMass    vector.V3
+
+	// Relative drift since the reference sample, which is the first one
+	// taken after particles were last added, removed, edited or merged.
+	EnergyDrift          float64
+	MomentumDrift        float64
+	AngularMomentumDrift float64
+
+	// Scale of the momenta, used to make their drift relative
+	momentumScale        float64
+	angularMomentumScale float64
+}
+
+func (d Diagnostics) Energy() float64 {
+	return d.Kinetic + d.Potential
+}
+
+// computeDiagnostics computes the conserved quantities of the particles in
+// s. The potential energy is computed exactly on the workers of wp, which
+// takes O(n²).
+func computeDiagnostics(wp *workerPool, k kernel, s *particleStore) Diagnostics {
+	d := Diagnostics{N: s.len()}
+
+	var cx, cy, cz float64
+
+	for i, m := range s.m {
+		r, v := s.pos[i], s.vel[i]
+		if m == 0 {
+			continue
+		}
+
+		d.Mass += m
+		d.Kinetic += m * v.Dot(v) / 2
+
+		mv := vector.V3{X: m * v.X, Y: m * v.Y, Z: m * v.Z}
+		d.Momentum = d.Momentum.Add(mv)
+		d.momentumScale += mv.Magnitude()
+
+		l := r.Cross(mv)
+		d.AngularMomentum = d.AngularMomentum.Add(l)
+		d.angularMomentumScale += l.Magnitude()
+
+		cx += m * r.X
+		cy += m * r.Y
+		cz += m * r.Z
+	}
+
+	if d.Mass != 0 {
+		d.CentreOfMass = vector.V3{X: cx / d.Mass, Y: cy / d.Mass, Z: cz / d.Mass}
+	}
+
+	d.Potential = pairPotential(wp, k, s)
+
+	return d
+}
+
+// pairPotential returns the potential energy of all pairs of particles in
+// s. Every row of pairs is summed on its own and the rows are added up in
+// order, so the result doesn't depend on the number of workers.
+func pairPotential(wp *workerPool, k kernel, s *particleStore) float64 {
+	n := s.len()
+	rows := make([]float64, n)
+
+	row := func(i int) {
+		// The distance is computed by hand, since the checks of the
+		// vector methods dominate the run time otherwise
+		pi := s.pos[i]
+		e := 0.0
+		for j := i + 1; j < n; j++ {
+			pj := s.pos[j]
+			dx, dy, dz := pj.X-pi.X, pj.Y-pi.Y, pj.Z-pi.Z
+			e += s.m[j] * k.phi(math.Sqrt(dx*dx+dy*dy+dz*dz))
+		}
+		rows[i] = k.G * s.m[i] * e
+	}
+
+	// Row i has n-1-i pairs, so every worker takes rows from both ends to
+	// get about the same number of pairs
+	half := (n + 1) / 2
+	wp.run(func(w int) {
+		lo, hi := wp.span(half, w)
+		for i := lo; i < hi; i++ {
+			row(i)
+			if j := n - 1 - i; j != i {
+				row(j)
+			}
+		}
+	})
+
+	e := 0.0
+	for _, r := range rows {
+		e += r
+	}
+	return e
+}
+
+// drift fills in the drift fields of d relative to ref.
+func (d *Diagnostics) drift(ref Diagnostics) {
+	rel := func(delta, scale float64) float64 {
+		if scale == 0 {
+			return delta
+		}
+		return delta / scale
+	}
+
+	d.EnergyDrift = rel(math.Abs(d.Energy()-ref.Energy()), math.Abs(ref.Energy()))
+	d.MomentumDrift = rel(d.Momentum.Distance(ref.Momentum), ref.momentumScale)
+	d.AngularMomentumDrift = rel(d.AngularMomentum.Distance(ref.AngularMomentum), ref.angularMomentumScale)
+}
+
+// Diagnostics computes the conserved quantities of the current state.
+func (o *Orrery) Diagnostics() Diagnostics {
+	o.l.Lock()
+	sample := o.sampleDiagnostics()
+	o.l.Unlock()
+
+	d := sample.compute(o)
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	o.measureDrift(&d)
+	return d
+}
+
+// DiagnosticsHistory returns the samples taken every DiagnosticsInterval
+// ticks, oldest first.
+func (o *Orrery) DiagnosticsHistory() []Diagnostics {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	r := make([]Diagnostics, len(o.history))
+	copy(r, o.history)
+
+	return r
+}
+
+// LastDiagnostics returns the most recently recorded sample, if any.
+func (o *Orrery) LastDiagnostics() (Diagnostics, bool) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	return o.lastDiagnostics()
+}
+
+// lastDiagnostics is LastDiagnostics for callers that hold o.l.
+func (o *Orrery) lastDiagnostics() (Diagnostics, bool) {
+	if len(o.history) == 0 {
+		return Diagnostics{}, false
+	}
+
+	return o.history[len(o.history)-1], true
+}
+
+// diagnosticsSample is a copy of the state that diagnostics are computed
+// from. Computing them takes O(n²), so it is done on the copy without
+// holding o.l.
+type diagnosticsSample struct {
+	tick uint64
+	time float64
+	s    *particleStore
+}
+
+// sampleDiagnostics copies the current state. The caller must hold o.l.
+func (o *Orrery) sampleDiagnostics() *diagnosticsSample {
+	return &diagnosticsSample{
+		tick: o.ticks,
+		time: o.time,
+		s:    o.particles.dynamics(),
+	}
+}
+
+// compute computes the diagnostics of the sample, without their drift.
+func (ds *diagnosticsSample) compute(o *Orrery) Diagnostics {
+	d := computeDiagnostics(o.pool, o.kernel, ds.s)
+	d.Tick = ds.tick
+	d.Time = ds.time
+
+	return d
+}
+
+// measureDrift fills in the drift of d, and makes d the reference if there
+// is none. The caller must hold o.l.
+func (o *Orrery) measureDrift(d *Diagnostics) {
+	if o.reference == nil || o.reference.N != d.N {
+		ref := *d
+		o.reference = &ref
+		o.drifting = false
+	}
+	d.drift(*o.reference)
+}
+
+// recordDiagnostics computes the diagnostics of sample, appends them to the
+// history and warns if any of the conserved quantities drifted too far. The
+// caller must not hold o.l.
+func (o *Orrery) recordDiagnostics(sample *diagnosticsSample) {
+	d := sample.compute(o)
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	o.measureDrift(&d)
+
+	o.history = append(o.history, d)
+	o.dirty = true
+	if len(o.history) > maxDiagnosticsHistory {
+		o.history = o.history[len(o.history)-maxDiagnosticsHistory:]
+	}
+
+	if o.driftThreshold <= 0 {
+		return
+	}
+
+	drifting := d.EnergyDrift > o.driftThreshold ||
+		d.MomentumDrift > o.driftThreshold ||
+		d.AngularMomentumDrift > o.driftThreshold
+	if drifting && !o.drifting {
+		log.Printf(`tick %d: conserved quantities drifted beyond %g: energy %g, momentum %g, angular momentum %g`,
+			d.Tick, o.driftThreshold, d.EnergyDrift, d.MomentumDrift, d.AngularMomentumDrift)
+	}
+	o.drifting = drifting
+}
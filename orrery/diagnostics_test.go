@@ -0,0 +1,170 @@
+package orrery
+
+import (
+	"math"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestComputeDiagnostics(t *testing.T) {
+	ps := []*Particle{
+		newParticle(1, vector.V3{X: -2}, vector.V3{Y: -1}),
+		newParticle(3, vector.V3{X: 2}, vector.V3{Y: 1}),
+	}
+
+	d := computeDiagnostics(testPool, testKernel, newParticleStore(ps))
+
+	if d.Mass != 4 {
+		t.Errorf(`expected mass 4, got %f`, d.Mass)
+	}
+	if d.Kinetic != 2 {
+		t.Errorf(`expected kinetic energy 2, got %f`, d.Kinetic)
+	}
+	if e := -testKernel.G * 1 * 3 / 4; d.Potential != e {
+		t.Errorf(`expected potential energy %f, got %f`, e, d.Potential)
+	}
+	if e := (vector.V3{Y: 2}); d.Momentum != e {
+		t.Errorf(`expected momentum %s, got %s`, e, d.Momentum)
+	}
+	if e := (vector.V3{Z: 8}); d.AngularMomentum != e {
+		t.Errorf(`expected angular momentum %s, got %s`, e, d.AngularMomentum)
+	}
+	if e := (vector.V3{X: 1}); d.CentreOfMass != e {
+		t.Errorf(`expected centre of mass %s, got %s`, e, d.CentreOfMass)
+	}
+}
+
+func TestDiagnosticsHistory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DiagnosticsInterval = 10
+	o := New(cfg)
+	defer o.Close()
+
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+
+	for i := 0; i < 1000; i++ {
+		o.tick()
+	}
+
+	h := o.DiagnosticsHistory()
+	if len(h) != 100 {
+		t.Fatalf(`expected 100 samples, got %d`, len(h))
+	}
+
+	last, ok := o.LastDiagnostics()
+	if !ok || last.Tick != 1000 {
+		t.Errorf(`expected last sample at tick 1000, got %d`, last.Tick)
+	}
+
+	for _, d := range h {
+		if d.EnergyDrift > 1e-3 || d.MomentumDrift > 1e-9 || d.AngularMomentumDrift > 1e-6 {
+			t.Errorf(`tick %d: unexpected drift: energy %g, momentum %g, angular momentum %g`,
+				d.Tick, d.EnergyDrift, d.MomentumDrift, d.AngularMomentumDrift)
+		}
+		if math.Abs(d.CentreOfMass.Magnitude()) > 1e-9 {
+			t.Errorf(`tick %d: centre of mass moved to %s`, d.Tick, d.CentreOfMass)
+		}
+	}
+}
+
+func TestDiagnosticsReference(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DiagnosticsInterval = 10
+	o := New(cfg)
+	defer o.Close()
+
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.assignIDs()
+	o.l.Unlock()
+
+	o.Step(10)
+
+	// None of these change the number of particles between two samples,
+	// but all of them change the energy
+	m, vel := 5.0, vector.V3{X: 0.3}
+	for _, c := range []command{
+		CommandEdit{ID: 1, M: &m},
+		CommandEdit{ID: 2, Vel: &vel},
+		CommandSpawnParticle{Pos: vector.V3{Y: 500}, Vel: vector.V3{X: 1}},
+	} {
+		if err := o.handleCommand(c); err != nil {
+			t.Fatalf(`%T: %s`, c, err)
+		}
+		o.Step(10)
+
+		last, _ := o.LastDiagnostics()
+		if last.EnergyDrift != 0 {
+			t.Errorf(`%T: expected a new reference, got energy drift %g`, c, last.EnergyDrift)
+		}
+	}
+
+	o.handleCommand(CommandDelete{ID: 3})
+	o.handleCommand(CommandSpawnParticle{Pos: vector.V3{Y: -500}, M: 50})
+	o.Step(10)
+	if last, _ := o.LastDiagnostics(); last.EnergyDrift != 0 {
+		t.Errorf(`expected a new reference after replacing a particle, got energy drift %g`, last.EnergyDrift)
+	}
+}
+
+func TestDiagnosticsAfterClose(t *testing.T) {
+	o := New(DefaultConfig())
+	o.l.Lock()
+	o.particles = newParticleStore(randomParticles(100, 1))
+	o.l.Unlock()
+
+	before := o.Diagnostics()
+
+	// Reading the state doesn't depend on the workers, also not while
+	// they are stopped
+	done := make(chan Diagnostics)
+	go func() {
+		d := Diagnostics{}
+		for i := 0; i < 20; i++ {
+			d = o.Diagnostics()
+		}
+		done <- d
+	}()
+	o.Close()
+
+	if d := <-done; d.Energy() != before.Energy() {
+		t.Errorf(`expected energy %f while closing, got %f`, before.Energy(), d.Energy())
+	}
+	if d := o.Diagnostics(); d.Energy() != before.Energy() {
+		t.Errorf(`expected energy %f after closing, got %f`, before.Energy(), d.Energy())
+	}
+}
+
+func TestPairPotentialWorkers(t *testing.T) {
+	ps := randomParticles(301, 6)
+	s := newParticleStore(ps)
+	ref := potentialEnergy(testKernel, ps, nil)
+
+	var first float64
+	for _, n := range []int{1, 2, 5} {
+		wp := newWorkerPool(n)
+		e := pairPotential(wp, testKernel, s)
+		wp.close()
+
+		if math.Abs(e-ref) > 1e-9*math.Abs(ref) {
+			t.Errorf(`%d workers: expected potential %f, got %f`, n, ref, e)
+		}
+		if n == 1 {
+			first = e
+		} else if e != first {
+			t.Errorf(`%d workers: potential %v differs from %v with one worker`, n, e, first)
+		}
+	}
+}
+
+func BenchmarkDiagnostics10000(b *testing.B) {
+	s := newParticleStore(randomParticles(10000, 3))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computeDiagnostics(testPool, testKernel, s)
+	}
+}
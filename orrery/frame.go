@@ -0,0 +1,129 @@
+package orrery
+
+import "sync/atomic"
+
+// Frame is an immutable view of the orrery at a single tick. The simulation
+// works on its own particle store and publishes a new frame at most once per
+// loop iteration, so readers like the UI neither see particles from
+// different ticks nor have to lock anything. Frames and their particles
+// must not be modified.
+//
+// Frames are reused once they are no longer needed, so every frame returned
+// by Orrery.Frame must be released with Release when the reader is done
+// with it, and must not be used afterwards.
+type Frame struct {
+	Tick      uint64
+	Time      float64
+	TimeScale float64
+	Paused    bool
+	Particles []*Particle
+
+	// Range of ticks that can be rewound to, see Orrery.RewindRange
+	RewindFirst, RewindLast uint64
+	CanRewind               bool
+
+	// Most recent diagnostics sample, see Orrery.LastDiagnostics
+	Diagnostics    Diagnostics
+	HasDiagnostics bool
+
+	refs int32      // readers, plus one while the frame is the current one
+	buf  []Particle // backing array of Particles
+}
+
+// Release hands the frame back to the orrery for reuse.
+func (f *Frame) Release() {
+	atomic.AddInt32(&f.refs, -1)
+}
+
+// freeFrame returns a frame that no reader holds any more, or a new one. The
+// caller must hold o.l.
+func (o *Orrery) freeFrame() *Frame {
+	for _, f := range o.frames {
+		if atomic.LoadInt32(&f.refs) == 0 {
+			return f
+		}
+	}
+
+	f := &Frame{}
+	o.frames = append(o.frames, f)
+	return f
+}
+
+// publish replaces the frame returned by Frame with the current state. The
+// caller must hold o.l.
+func (o *Orrery) publish() {
+	s := o.particles
+	f := o.freeFrame()
+
+	f.Tick = o.ticks
+	f.Time = o.time
+	f.TimeScale = o.timeScale
+	f.Paused = o.Paused
+	f.RewindFirst, f.RewindLast, f.CanRewind = o.rewindRange()
+	f.Diagnostics, f.HasDiagnostics = o.lastDiagnostics()
+
+	// All particles of a frame share a single allocation, which is kept
+	// when the frame is reused
+	if cap(f.buf) < s.len() {
+		f.buf = make([]Particle, s.len())
+		f.Particles = make([]*Particle, s.len())
+	}
+	f.buf = f.buf[:s.len()]
+	f.Particles = f.Particles[:s.len()]
+
+	for i := range f.buf {
+		p := &f.buf[i]
+		p.ID = s.id[i]
+		p.T = s.t[i]
+		p.R = s.r[i]
+		p.M = s.m[i]
+		p.Pos = s.pos[i]
+		p.Vel = s.vel[i]
+		p.dt = s.dt[i]
+		p.stepErr = s.stepErr[i]
+
+		// Trails are shared, see particleStore.updateTrails. The
+		// capacity is capped so that appending to the frame's trail
+		// can't write into the store's.
+		t := s.trail[i]
+		p.Trail = t[:len(t):len(t)]
+
+		f.Particles[i] = p
+	}
+
+	// Readers can only take the frame once it is complete
+	atomic.StoreInt32(&f.refs, 1)
+	if old, ok := o.frame.Load().(*Frame); ok {
+		o.frame.Store(f)
+		old.Release()
+	} else {
+		o.frame.Store(f)
+	}
+	o.dirty = false
+}
+
+// publishIfDirty publishes a frame if the state changed since the last one.
+func (o *Orrery) publishIfDirty() {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.dirty {
+		o.publish()
+	}
+}
+
+// Frame returns the most recently published state. It doesn't block, and
+// can be called from any goroutine. The frame must be released when it is
+// no longer needed.
+func (o *Orrery) Frame() *Frame {
+	for {
+		f := o.frame.Load().(*Frame)
+
+		// A frame without references may already be rewritten for a
+		// later state, in which case the new current frame is taken
+		r := atomic.LoadInt32(&f.refs)
+		if r > 0 && atomic.CompareAndSwapInt32(&f.refs, r, r+1) {
+			return f
+		}
+	}
+}
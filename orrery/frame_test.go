@@ -0,0 +1,125 @@
+package orrery
+
+import (
+	"sync"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestFrame(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 1
+	cfg.DiagnosticsInterval = 5
+	cfg.RewindLength = 10
+	cfg.RewindInterval = 5
+	o := New(cfg)
+	defer o.Close()
+
+	f := o.Frame()
+	if len(f.Particles) != 0 || !f.Paused {
+		t.Errorf(`expected an empty, paused first frame, got %d particles, paused %v`, len(f.Particles), f.Paused)
+	}
+	f.Release()
+
+	o.QueueCommand(CommandSpawnVolume{}).Wait()
+	f = o.Frame()
+	if len(f.Particles) != 10 || f.Tick != 0 {
+		t.Fatalf(`expected 10 particles at tick 0, got %d at %d`, len(f.Particles), f.Tick)
+	}
+	pos := f.Particles[0].Pos
+
+	// A frame that is held isn't reused
+	o.Step(10)
+	if f.Particles[0].Pos != pos || f.Tick != 0 {
+		t.Errorf(`published frame changed while stepping`)
+	}
+	f.Release()
+
+	f = o.Frame()
+	if f.Tick != 10 || f.Time != 10 {
+		t.Errorf(`expected frame at tick 10, got tick %d, time %f`, f.Tick, f.Time)
+	}
+	samePositions(t, f.Particles, o.Particles())
+
+	if first, last, ok := o.RewindRange(); f.RewindFirst != first || f.RewindLast != last || f.CanRewind != ok || !ok {
+		t.Errorf(`expected rewind range %d to %d, got %d to %d`, first, last, f.RewindFirst, f.RewindLast)
+	}
+	if !f.HasDiagnostics || f.Diagnostics.Tick != 10 || f.Diagnostics.N != 10 {
+		t.Errorf(`expected diagnostics of 10 particles at tick 10, got %d at %d (%v)`, f.Diagnostics.N, f.Diagnostics.Tick, f.HasDiagnostics)
+	}
+	f.Release()
+
+	// Released frames are reused instead of allocating new ones
+	for i := 0; i < 10; i++ {
+		o.Step(1)
+		o.Frame().Release()
+	}
+	o.l.Lock()
+	if n := len(o.frames); n > 3 {
+		t.Errorf(`expected frames to be reused, got %d`, n)
+	}
+	o.l.Unlock()
+
+	o.QueueCommand(CommandPause{}).Wait()
+	f = o.Frame()
+	if f.Paused {
+		t.Errorf(`expected unpaused frame`)
+	}
+	f.Release()
+}
+
+func TestFrameConcurrentReaders(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 1
+	o := New(cfg)
+	defer o.Close()
+
+	o.QueueCommand(CommandSpawnParticle{M: 1000}).Wait()
+	o.QueueCommand(CommandSpawnOrbit{Parent: 1, Pos: vector.V3{X: 50}, M: 1}).Wait()
+
+	done := make(chan struct{})
+	started := sync.WaitGroup{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				if n == 1 {
+					started.Done()
+				}
+
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Every frame is consistent: the orbit keeps its radius,
+				// and the frame doesn't change while it is held
+				f := o.Frame()
+				tick, pos := f.Tick, f.Particles[1].Pos
+				if d := f.Particles[0].Pos.Distance(pos); d < 45 || d > 55 {
+					t.Errorf(`tick %d: inconsistent distance %f`, f.Tick, d)
+				}
+				for _, p := range f.Particles {
+					_ = len(p.Trail)
+				}
+				if f.Tick != tick || f.Particles[1].Pos != pos {
+					t.Errorf(`tick %d: frame changed while held`, tick)
+				}
+				f.Release()
+			}
+		}()
+	}
+
+	// Every step publishes a frame while the readers are running
+	started.Wait()
+	for i := 0; i < 500; i++ {
+		o.Step(1)
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,305 @@
+package orrery
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// Generator creates initial conditions. Velocities are derived from the
+// gravity kernel, so generated systems are in equilibrium for the G they
+// are simulated with.
+type Generator interface {
+	fmt.Stringer
+	generate(k kernel, rng *rand.Rand) ([]*Particle, error)
+}
+
+// Plummer is a Plummer sphere of N particles with a total mass of Mass and
+// the scale radius Radius, in virial equilibrium.
+type Plummer struct {
+	N      int
+	Mass   float64
+	Radius float64
+}
+
+// Disc is a rotating, thin exponential disc of N particles with a total
+// mass of Mass, around a central particle of mass CentralMass. Particles
+// move on circular orbits around the mass inside their radius.
+type Disc struct {
+	N           int
+	Mass        float64
+	CentralMass float64
+	ScaleLength float64
+	ScaleHeight float64
+}
+
+// Binaries is a hierarchy of N particles with a total mass of Mass. The
+// particles are split into two halves that orbit each other at distance
+// Separation, and each half is split the same way with its separation
+// scaled by Ratio.
+type Binaries struct {
+	N          int
+	Mass       float64
+	Separation float64
+	Ratio      float64
+}
+
+// SolarSystem is a sun of mass Mass with up to eight planets. Their masses
+// relative to the sun and their orbital radii in astronomical units are
+// those of the solar system, AU is the length of one astronomical unit.
+type SolarSystem struct {
+	Planets int
+	Mass    float64
+	AU      float64
+}
+
+func (Plummer) String() string     { return "plummer" }
+func (Disc) String() string        { return "disc" }
+func (Binaries) String() string    { return "binaries" }
+func (SolarSystem) String() string { return "solar-system" }
+
+// randomDirection returns a uniformly distributed unit vector.
+func randomDirection(rng *rand.Rand) vector.V3 {
+	z := 2*rng.Float64() - 1
+	phi := 2 * math.Pi * rng.Float64()
+	s := math.Sqrt(1 - z*z)
+	return vector.V3{X: s * math.Cos(phi), Y: s * math.Sin(phi), Z: z}
+}
+
+// perpendicular returns a unit vector perpendicular to v.
+func perpendicular(v vector.V3) vector.V3 {
+	p := v.Cross(vector.V3{X: 1})
+	if p.Magnitude() < 0.1*v.Magnitude() {
+		p = v.Cross(vector.V3{Y: 1})
+	}
+	return p.Normalized()
+}
+
+// potentialEnergy returns the potential energy of the particles. Above
+// maxPairs pairs, it is estimated from that many randomly chosen pairs.
+func potentialEnergy(k kernel, ps []*Particle, rng *rand.Rand) float64 {
+	const maxPairs = 1 << 20
+
+	n := len(ps)
+	pairs := n * (n - 1) / 2
+
+	w := 0.0
+	if pairs <= maxPairs {
+		for i := range ps {
+			for j := i + 1; j < n; j++ {
+				w += k.potential(ps[i].M, ps[j].M, ps[i].Pos.Distance(ps[j].Pos))
+			}
+		}
+		return w
+	}
+
+	for s := 0; s < maxPairs; s++ {
+		i := rng.Intn(n)
+		j := rng.Intn(n - 1)
+		if j >= i {
+			j++
+		}
+		w += k.potential(ps[i].M, ps[j].M, ps[i].Pos.Distance(ps[j].Pos))
+	}
+	return w * float64(pairs) / maxPairs
+}
+
+// toCentreOfMassFrame moves the particles so that their centre of mass is
+// at rest at the origin.
+func toCentreOfMassFrame(ps []*Particle) {
+	m := 0.0
+	com, mom := vector.V3{}, vector.V3{}
+	for _, p := range ps {
+		m += p.M
+		com = com.Add(p.Pos.Scaled(p.M))
+		mom = mom.Add(p.Vel.Scaled(p.M))
+	}
+	com, vel := com.Scaled(1/m), mom.Scaled(1/m)
+
+	for _, p := range ps {
+		p.Pos = p.Pos.Sub(com)
+		p.Vel = p.Vel.Sub(vel)
+	}
+}
+
+// generate samples positions and velocities from the Plummer distribution
+// function (Aarseth, Hénon and Wielen 1974) for G = 1, and then scales the
+// velocities so that the system is in virial equilibrium, 2K = -W, with
+// the potential of k.
+func (g Plummer) generate(k kernel, rng *rand.Rand) ([]*Particle, error) {
+	if g.N < 2 || g.Mass <= 0 || g.Radius <= 0 {
+		return nil, errors.New(`plummer sphere needs at least 2 particles, a positive mass and radius`)
+	}
+
+	m := g.Mass / float64(g.N)
+	ps := make([]*Particle, g.N)
+	for i := range ps {
+		// Cut off the few particles beyond ~10 scale radii
+		x := rng.Float64()*0.99 + 1e-9
+		r := 1 / math.Sqrt(math.Pow(x, -2.0/3)-1)
+
+		q, y := 0.0, 1.0
+		for y > q*q*math.Pow(1-q*q, 3.5) {
+			q, y = rng.Float64(), rng.Float64()*0.1
+		}
+		v := q * math.Sqrt2 * math.Pow(1+r*r, -0.25)
+
+		ps[i] = newParticle(m, randomDirection(rng).Scaled(r*g.Radius), randomDirection(rng).Scaled(v))
+	}
+	toCentreOfMassFrame(ps)
+
+	kin := 0.0
+	for _, p := range ps {
+		kin += p.M * p.Vel.Dot(p.Vel) / 2
+	}
+	w := potentialEnergy(k, ps, rng)
+	if kin > 0 && w < 0 {
+		s := math.Sqrt(-w / (2 * kin))
+		for _, p := range ps {
+			p.Vel = p.Vel.Scaled(s)
+		}
+	}
+
+	return ps, nil
+}
+
+func (g Disc) generate(k kernel, rng *rand.Rand) ([]*Particle, error) {
+	if g.N < 1 || g.Mass <= 0 || g.CentralMass < 0 || g.ScaleLength <= 0 || g.ScaleHeight < 0 {
+		return nil, errors.New(`disc needs at least 1 particle, positive masses and scale lengths`)
+	}
+
+	ps := []*Particle{}
+	if g.CentralMass > 0 {
+		ps = append(ps, newParticle(g.CentralMass, vector.V3{}, vector.V3{}))
+	}
+
+	m := g.Mass / float64(g.N)
+	for i := 0; i < g.N; i++ {
+		// The radii of an exponential disc follow a gamma distribution
+		// with shape 2, which is the sum of two exponential ones.
+		x := math.Inf(1)
+		for x > 10 {
+			x = rng.ExpFloat64() + rng.ExpFloat64()
+		}
+		r := x * g.ScaleLength
+		phi := 2 * math.Pi * rng.Float64()
+
+		pos := vector.V3{
+			X: r * math.Cos(phi),
+			Y: r * math.Sin(phi),
+			Z: rng.NormFloat64() * g.ScaleHeight,
+		}
+
+		// Mass inside r, treated as a point mass at the centre
+		inner := g.CentralMass + g.Mass*(1-(1+x)*math.Exp(-x))
+		v := 0.0
+		if inner > 0 {
+			v = k.orbitalSpeed(m, inner, r)
+		}
+		vel := vector.V3{X: -math.Sin(phi) * v, Y: math.Cos(phi) * v}
+
+		ps = append(ps, newParticle(m, pos, vel))
+	}
+
+	return ps, nil
+}
+
+func (g Binaries) generate(k kernel, rng *rand.Rand) ([]*Particle, error) {
+	if g.N < 1 || g.Mass <= 0 || g.Separation <= 0 || g.Ratio <= 0 || g.Ratio >= 1 {
+		return nil, errors.New(`binaries need at least 1 particle, a positive mass and separation and a ratio between 0 and 1`)
+	}
+
+	var split func(n int, m, sep float64, pos, vel vector.V3) []*Particle
+	split = func(n int, m, sep float64, pos, vel vector.V3) []*Particle {
+		if n == 1 {
+			return []*Particle{newParticle(m, pos, vel)}
+		}
+
+		n1 := n / 2
+		m1 := m * float64(n1) / float64(n)
+		m2 := m - m1
+
+		// Random orientation of the orbit
+		axis := randomDirection(rng)
+		dir := perpendicular(axis)
+		v := k.orbitalSpeed(m1, m2, sep)
+		tangent := axis.Cross(dir).Normalized()
+
+		r1, r2 := dir.Scaled(sep*m2/m), dir.Scaled(-sep*m1/m)
+		v1, v2 := tangent.Scaled(v*m2/m), tangent.Scaled(-v*m1/m)
+
+		res := split(n1, m1, sep*g.Ratio, pos.Add(r1), vel.Add(v1))
+		return append(res, split(n-n1, m2, sep*g.Ratio, pos.Add(r2), vel.Add(v2))...)
+	}
+
+	return split(g.N, g.Mass, g.Separation, vector.V3{}, vector.V3{}), nil
+}
+
+// Masses relative to the sun and semi-major axes in AU of the planets
+var solarPlanets = []struct {
+	m, a float64
+}{
+	{1.66e-7, 0.387}, // Mercury
+	{2.45e-6, 0.723}, // Venus
+	{3.00e-6, 1.000}, // Earth
+	{3.23e-7, 1.524}, // Mars
+	{9.55e-4, 5.203}, // Jupiter
+	{2.86e-4, 9.537}, // Saturn
+	{4.37e-5, 19.19}, // Uranus
+	{5.15e-5, 30.07}, // Neptune
+}
+
+func (g SolarSystem) generate(k kernel, rng *rand.Rand) ([]*Particle, error) {
+	if g.Planets < 0 || g.Planets > len(solarPlanets) || g.Mass <= 0 || g.AU <= 0 {
+		return nil, fmt.Errorf(`solar system needs 0 to %d planets, a positive mass and AU`, len(solarPlanets))
+	}
+
+	ps := []*Particle{newParticle(g.Mass, vector.V3{}, vector.V3{})}
+	for _, pl := range solarPlanets[:g.Planets] {
+		m := pl.m * g.Mass
+		r := pl.a * g.AU
+		phi := 2 * math.Pi * rng.Float64()
+		v := k.orbitalSpeed(m, g.Mass, r)
+
+		pos := vector.V3{X: r * math.Cos(phi), Y: r * math.Sin(phi)}
+		vel := vector.V3{X: -math.Sin(phi) * v, Y: math.Cos(phi) * v}
+		ps = append(ps, newParticle(m, pos, vel))
+	}
+	toCentreOfMassFrame(ps)
+
+	return ps, nil
+}
+
+// Generate adds the particles created by g, shifted by pos and vel. A seed
+// of 0 uses the random number generator of the orrery.
+func (o *Orrery) Generate(g Generator, seed int64, pos, vel vector.V3) error {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if !(o.kernel.G > 0) {
+		// Velocities are derived from orbital speeds, which are 0 or NaN
+		return fmt.Errorf(`can't generate with gravitational constant %f`, o.kernel.G)
+	}
+
+	rng := o.rng
+	if seed != 0 {
+		rng = rand.New(rand.NewSource(seed))
+	}
+
+	ps, err := g.generate(o.kernel, rng)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		p.Pos = p.Pos.Add(pos)
+		p.Vel = p.Vel.Add(vel)
+		o.addParticle(p)
+	}
+	o.dirty = true
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package orrery
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func centreOfMass(ps []*Particle) (m float64, com, mom vector.V3) {
+	for _, p := range ps {
+		m += p.M
+		com = com.Add(p.Pos.Scaled(p.M))
+		mom = mom.Add(p.Vel.Scaled(p.M))
+	}
+	return m, com.Scaled(1 / m), mom
+}
+
+func TestPlummer(t *testing.T) {
+	ps, err := Plummer{N: 500, Mass: 1000, Radius: 50}.generate(testKernel, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 500 {
+		t.Fatalf(`expected 500 particles, got %d`, len(ps))
+	}
+
+	m, com, mom := centreOfMass(ps)
+	if math.Abs(m-1000) > 1e-9 || com.Magnitude() > 1e-9 || mom.Magnitude() > 1e-9 {
+		t.Errorf(`expected mass 1000 at rest at the origin, got %f at %s moving with %s`, m, com, mom)
+	}
+
+	kin := 0.0
+	for _, p := range ps {
+		kin += p.M * p.Vel.Dot(p.Vel) / 2
+	}
+	w := potentialEnergy(testKernel, ps, nil)
+	if q := 2 * kin / -w; math.Abs(q-1) > 1e-9 {
+		t.Errorf(`expected virial ratio 1, got %f`, q)
+	}
+}
+
+func TestDisc(t *testing.T) {
+	g := Disc{N: 200, Mass: 100, CentralMass: 1000, ScaleLength: 20, ScaleHeight: 1}
+	ps, err := g.generate(testKernel, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 201 || ps[0].M != 1000 {
+		t.Fatalf(`expected a central particle and 200 disc particles, got %d`, len(ps))
+	}
+
+	for _, p := range ps[1:] {
+		l := p.Pos.Cross(p.Vel)
+		if l.Z <= 0 || p.Vel.Z != 0 {
+			t.Fatalf(`particle doesn't rotate in the XY plane: %s`, p)
+		}
+		if p.Pos.Magnitude() > 10*g.ScaleLength+10*g.ScaleHeight {
+			t.Errorf(`particle outside of the disc: %s`, p)
+		}
+	}
+}
+
+func TestBinaries(t *testing.T) {
+	g := Binaries{N: 7, Mass: 70, Separation: 100, Ratio: 0.1}
+	ps, err := g.generate(testKernel, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 7 {
+		t.Fatalf(`expected 7 particles, got %d`, len(ps))
+	}
+
+	m, com, mom := centreOfMass(ps)
+	if math.Abs(m-70) > 1e-9 || com.Magnitude() > 1e-9 || mom.Magnitude() > 1e-9 {
+		t.Errorf(`expected mass 70 at rest at the origin, got %f at %s moving with %s`, m, com, mom)
+	}
+
+	// The first split is 3 against 4 particles
+	_, c1, _ := centreOfMass(ps[:3])
+	_, c2, _ := centreOfMass(ps[3:])
+	if d := c1.Distance(c2); math.Abs(d-100) > 1e-9 {
+		t.Errorf(`expected the halves 100 apart, got %f`, d)
+	}
+	if d := ps[5].Pos.Distance(ps[6].Pos); math.Abs(d-1) > 1e-9 {
+		t.Errorf(`expected the innermost pair 1 apart, got %f`, d)
+	}
+}
+
+func TestSolarSystem(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.Generate(SolarSystem{Planets: 8, Mass: 1000, AU: 40}, 1, vector.V3{X: 100}, vector.V3{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := o.Particles()
+	if len(ps) != 9 {
+		t.Fatalf(`expected a sun and 8 planets, got %d`, len(ps))
+	}
+	if d := ps[3].Pos.Distance(ps[0].Pos); math.Abs(d-40) > 0.1 {
+		t.Errorf(`expected earth at 1 AU, got %f`, d)
+	}
+	if ps[0].Pos.X < 99 || ps[0].Pos.X > 101 {
+		t.Errorf(`expected the sun near x=100, got %s`, ps[0].Pos)
+	}
+}
+
+func TestGenerateSeeded(t *testing.T) {
+	gen := func(seed int64) []*Particle {
+		o := New(DefaultConfig())
+		defer o.Close()
+		o.handleCommand(CommandGenerate{Generator: Plummer{N: 50, Mass: 100, Radius: 10}, Seed: seed})
+		return o.Particles()
+	}
+
+	a, b, c := gen(7), gen(7), gen(8)
+	for i := range a {
+		if a[i].Pos != b[i].Pos || a[i].Vel != b[i].Vel {
+			t.Fatalf(`particle %d differs between runs with the same seed`, i)
+		}
+	}
+	if a[0].Pos == c[0].Pos {
+		t.Errorf(`runs with different seeds are identical`)
+	}
+}
+
+func TestGeneratorParameters(t *testing.T) {
+	for _, g := range []Generator{
+		Plummer{N: 1, Mass: 1, Radius: 1},
+		Disc{N: 10, Mass: 1},
+		Binaries{N: 2, Mass: 1, Separation: 1, Ratio: 1},
+		SolarSystem{Planets: 9, Mass: 1, AU: 1},
+	} {
+		_, err := g.generate(testKernel, rand.New(rand.NewSource(1)))
+		if err == nil {
+			t.Errorf(`%s: expected an error for %+v`, g, g)
+		}
+	}
+}
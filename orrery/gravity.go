@@ -0,0 +1,404 @@
+package orrery
+
+import (
+	"fmt"
+	"math"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// Softening selects how gravity is weakened at short distances, so that
+// close encounters don't cause arbitrarily large accelerations.
+type Softening int
+
+const (
+	// SOFTEN_PLUMMER replaces every particle with a Plummer sphere of
+	// radius epsilon. The force is weakened at all distances, but the
+	// difference vanishes quickly beyond epsilon.
+	SOFTEN_PLUMMER Softening = iota
+	// SOFTEN_SPLINE spreads every particle out with the cubic spline
+	// kernel of Monaghan and Lattanzio (1985). The force is exactly
+	// Newtonian beyond 2.8 epsilon, which makes the potential comparable
+	// to that of Plummer softening with the same epsilon.
+	SOFTEN_SPLINE
+)
+
+func (s Softening) String() string {
+	switch s {
+	case SOFTEN_PLUMMER:
+		return "plummer"
+	case SOFTEN_SPLINE:
+		return "spline"
+	default:
+		return fmt.Sprintf("Softening(%d)", int(s))
+	}
+}
+
+// kernel describes the gravitational interaction between two particles: the
+// gravitational constant, and the softening length Epsilon. An Epsilon of 0
+// gives unsoftened Newtonian gravity.
+type kernel struct {
+	G         float64
+	Epsilon   float64
+	Softening Softening
+}
+
+// Gravity computes the gravitational acceleration of the particles with the
+// indices in active, or of all particles if active is nil, with the mass in
+// m as if they were at the positions in pos, and stores it in acc. The
+// accelerations of the other particles are left alone. The work is spread
+// over the workers of wp.
+type Gravity interface {
+	fmt.Stringer
+	accelerate(wp *workerPool, k kernel, m []float64, pos []vector.V3, active []int, acc []vector.V3)
+}
+
+// activeCount returns the number of particles selected by active out of n.
+func activeCount(active []int, n int) int {
+	if active == nil {
+		return n
+	}
+	return len(active)
+}
+
+// activeIndex returns the index of the r-th particle selected by active.
+func activeIndex(active []int, r int) int {
+	if active == nil {
+		return r
+	}
+	return active[r]
+}
+
+// Pairwise is the exact O(n²) gravity solver. It is slow, but serves as the
+// reference for the approximating solvers.
+type Pairwise struct{}
+
+func (Pairwise) String() string { return "pairwise" }
+
+func (Pairwise) accelerate(wp *workerPool, k kernel, m []float64, pos []vector.V3, active []int, acc []vector.V3) {
+	// Every worker owns a range of rows and sums the acceleration of each
+	// of them over all other particles in the same order. Nothing has to be
+	// locked, and the result doesn't depend on the number of workers, at
+	// the cost of computing every pair twice.
+	n := len(m)
+
+	wp.run(func(w int) {
+		lo, hi := wp.span(activeCount(active, n), w)
+		for r := lo; r < hi; r++ {
+			i := activeIndex(active, r)
+			a := vector.V3{}
+			if m[i] == 0 {
+				acc[i] = a
+				continue
+			}
+			for j := 0; j < n; j++ {
+				if j == i || m[j] == 0 {
+					continue
+				}
+
+				d := pos[j].Sub(pos[i])
+				f := k.G * k.force(d.Magnitude())
+				if f == 0 {
+					continue
+				}
+				a = a.Add(d.Scaled(f * m[j]))
+			}
+			acc[i] = a
+		}
+	})
+}
+
+// BarnesHut approximates gravity with an octree in O(n log n). Nodes whose
+// size divided by their distance is below Theta are treated as a single
+// body at their centre of mass. A Theta of 0 gives the exact result.
+type BarnesHut struct {
+	Theta float64
+}
+
+func (BarnesHut) String() string { return "barnes-hut" }
+
+// Octree nodes below this depth are not split any further, so that
+// coincident particles can't make the tree infinitely deep.
+const bhMaxDepth = 32
+
+type bhNode struct {
+	centre vector.V3
+	size   float64 // edge length of the cube
+
+	m   float64   // total mass
+	n   int       // number of particles
+	com vector.V3 // centre of mass
+
+	children [8]*bhNode
+	bodies   []int // indices of the particles in this node, only set for leaves
+}
+
+type bhTree struct {
+	k    kernel
+	root *bhNode
+	m    []float64
+	pos  []vector.V3
+}
+
+func (b *bhNode) leaf() bool {
+	for _, c := range b.children {
+		if c != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bhNode) octant(pos vector.V3) int {
+	i := 0
+	if pos.X >= b.centre.X {
+		i |= 1
+	}
+	if pos.Y >= b.centre.Y {
+		i |= 2
+	}
+	if pos.Z >= b.centre.Z {
+		i |= 4
+	}
+	return i
+}
+
+func (b *bhNode) child(i int) *bhNode {
+	if b.children[i] != nil {
+		return b.children[i]
+	}
+
+	q := b.size / 4
+	c := b.centre
+	if i&1 != 0 {
+		c.X += q
+	} else {
+		c.X -= q
+	}
+	if i&2 != 0 {
+		c.Y += q
+	} else {
+		c.Y -= q
+	}
+	if i&4 != 0 {
+		c.Z += q
+	} else {
+		c.Z -= q
+	}
+
+	b.children[i] = &bhNode{centre: c, size: b.size / 2}
+	return b.children[i]
+}
+
+func (t *bhTree) insert(b *bhNode, i int, depth int) {
+	if b.leaf() && (len(b.bodies) == 0 || depth >= bhMaxDepth) {
+		b.bodies = append(b.bodies, i)
+		return
+	}
+
+	if b.leaf() {
+		// Split: push the current occupant down one level
+		for _, j := range b.bodies {
+			t.insert(b.child(b.octant(t.pos[j])), j, depth+1)
+		}
+		b.bodies = nil
+	}
+
+	t.insert(b.child(b.octant(t.pos[i])), i, depth+1)
+}
+
+// summarize computes mass, particle count and centre of mass for the subtree at b.
+func (t *bhTree) summarize(b *bhNode) {
+	var mx, my, mz float64
+
+	add := func(m float64, n int, pos vector.V3) {
+		b.m += m
+		b.n += n
+		mx += pos.X * m
+		my += pos.Y * m
+		mz += pos.Z * m
+	}
+
+	for _, i := range b.bodies {
+		add(t.m[i], 1, t.pos[i])
+	}
+	for _, c := range b.children {
+		if c == nil {
+			continue
+		}
+		t.summarize(c)
+		add(c.m, c.n, c.com)
+	}
+
+	if b.m != 0 {
+		b.com = vector.V3{X: mx / b.m, Y: my / b.m, Z: mz / b.m}
+	} else {
+		b.com = b.centre
+	}
+}
+
+// accel returns the acceleration that the bodies in b cause on particle i.
+// The kernel is the same as in Pairwise, which is exact for leaves
+// holding single particles.
+func (t *bhTree) accel(b *bhNode, i int, theta float64) vector.V3 {
+	a := vector.V3{}
+	pos := t.pos[i]
+
+	if b.leaf() {
+		for _, j := range b.bodies {
+			if j == i {
+				continue
+			}
+			a = a.Add(t.k.accel(pos, t.m[j], t.pos[j]))
+		}
+		return a
+	}
+
+	d := b.com.Distance(pos)
+	if d > 0 && b.size/d < theta {
+		return t.k.accel(pos, b.m, b.com)
+	}
+
+	for _, c := range b.children {
+		if c == nil || c.n == 0 {
+			continue
+		}
+		a = a.Add(t.accel(c, i, theta))
+	}
+
+	return a
+}
+
+// force returns f such that a unit mass at distance d causes the
+// acceleration G·f·d. Without softening, f is 1/d³.
+func (k kernel) force(d float64) float64 {
+	if d == 0 {
+		// Coincident particles pull in no direction at all
+		return 0
+	}
+
+	eps := k.Epsilon
+	if eps == 0 {
+		return 1 / (d * d * d)
+	}
+
+	switch k.Softening {
+	case SOFTEN_SPLINE:
+		h := 2.8 * eps
+		u := d / h
+		switch {
+		case u < 0.5:
+			return (32.0/3 + u*u*(32*u-38.4)) / (h * h * h)
+		case u < 1:
+			return (64.0/3 - 48*u + 38.4*u*u - 32.0/3*u*u*u - 1.0/15/(u*u*u)) / (h * h * h)
+		}
+		return 1 / (d * d * d)
+	default:
+		return math.Pow(d*d+eps*eps, -1.5)
+	}
+}
+
+// phi returns the potential of a unit mass at distance d, without G. It is
+// -1/d without softening.
+func (k kernel) phi(d float64) float64 {
+	eps := k.Epsilon
+	if eps == 0 {
+		return -1 / d
+	}
+
+	switch k.Softening {
+	case SOFTEN_SPLINE:
+		h := 2.8 * eps
+		u := d / h
+		switch {
+		case u < 0.5:
+			return (-2.8 + u*u*(16.0/3+u*u*(6.4*u-9.6))) / h
+		case u < 1:
+			return (-3.2 + 1.0/15/u + u*u*(32.0/3+u*(-16+u*(9.6-32.0/15*u)))) / h
+		}
+		return -1 / d
+	default:
+		return -1 / math.Sqrt(d*d+eps*eps)
+	}
+}
+
+// accel returns the acceleration a particle at pos feels from the mass mx
+// at posx.
+func (k kernel) accel(pos vector.V3, mx float64, posx vector.V3) vector.V3 {
+	v := posx.Sub(pos)
+
+	a := k.G * mx * k.force(v.Magnitude())
+	if a == 0 {
+		return vector.V3{}
+	}
+
+	return v.Scaled(a)
+}
+
+// orbitalSpeed returns the relative speed at which particles of masses m and
+// mx at distance d orbit each other on a circle, consistent with accel.
+func (k kernel) orbitalSpeed(m, mx, d float64) float64 {
+	return math.Sqrt(k.G * (m + mx) * k.force(d) * d * d)
+}
+
+// potential returns the potential energy between two particles of masses m
+// and mx at distance d, consistent with accel.
+func (k kernel) potential(m, mx, d float64) float64 {
+	return k.G * m * mx * k.phi(d)
+}
+
+func newBHTree(k kernel, m []float64, pos []vector.V3) *bhTree {
+	min, max := pos[0], pos[0]
+	for _, p := range pos[1:] {
+		min.X = math.Min(min.X, p.X)
+		min.Y = math.Min(min.Y, p.Y)
+		min.Z = math.Min(min.Z, p.Z)
+		max.X = math.Max(max.X, p.X)
+		max.Y = math.Max(max.Y, p.Y)
+		max.Z = math.Max(max.Z, p.Z)
+	}
+
+	size := math.Max(max.X-min.X, math.Max(max.Y-min.Y, max.Z-min.Z))
+	// Pad a bit so that particles on the upper boundary are inside the root
+	size = size*1.01 + 1
+
+	root := &bhNode{
+		centre: vector.V3{
+			X: (min.X + max.X) / 2,
+			Y: (min.Y + max.Y) / 2,
+			Z: (min.Z + max.Z) / 2,
+		},
+		size: size,
+	}
+
+	t := &bhTree{k: k, root: root, m: m, pos: pos}
+	for i, mi := range m {
+		if mi == 0 {
+			continue
+		}
+		t.insert(root, i, 0)
+	}
+	t.summarize(root)
+
+	return t
+}
+
+func (bh BarnesHut) accelerate(wp *workerPool, k kernel, m []float64, pos []vector.V3, active []int, acc []vector.V3) {
+	if len(m) == 0 || activeCount(active, len(m)) == 0 {
+		return
+	}
+
+	t := newBHTree(k, m, pos)
+
+	wp.run(func(w int) {
+		lo, hi := wp.span(activeCount(active, len(m)), w)
+		for r := lo; r < hi; r++ {
+			i := activeIndex(active, r)
+			if m[i] == 0 {
+				acc[i] = vector.V3{}
+				continue
+			}
+			acc[i] = t.accel(t.root, i, bh.Theta)
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package orrery
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func randomParticles(n int, seed int64) []*Particle {
+	r := rand.New(rand.NewSource(seed))
+
+	ps := []*Particle{}
+	for i := 0; i < n; i++ {
+		pos := vector.V3{
+			X: (r.Float64() - 0.5) * 300,
+			Y: (r.Float64() - 0.5) * 300,
+			Z: (r.Float64() - 0.5) * 300,
+		}
+		ps = append(ps, newParticle(1+r.Float64()*4, pos, vector.V3{}))
+	}
+
+	return ps
+}
+
+func positions(ps []*Particle) []vector.V3 {
+	r := []vector.V3{}
+	for _, p := range ps {
+		r = append(r, p.Pos)
+	}
+
+	return r
+}
+
+func masses(ps []*Particle) []float64 {
+	r := []float64{}
+	for _, p := range ps {
+		r = append(r, p.M)
+	}
+
+	return r
+}
+
+var (
+	testKernel = kernel{G: 0.5}
+	testPool   = newWorkerPool(0)
+)
+
+func accelerations(g Gravity, ps []*Particle) []vector.V3 {
+	acc := make([]vector.V3, len(ps))
+	g.accelerate(testPool, testKernel, masses(ps), positions(ps), nil, acc)
+
+	return acc
+}
+
+// pairwise returns an accelFunc that uses the exact gravity solver.
+func pairwise(s *particleStore) accelFunc {
+	return func(pos []vector.V3, active []int, acc []vector.V3) {
+		Pairwise{}.accelerate(testPool, testKernel, s.m, pos, active, acc)
+	}
+}
+
+func TestBarnesHutExact(t *testing.T) {
+	ps := randomParticles(200, 1)
+
+	exact := accelerations(Pairwise{}, ps)
+	bh := accelerations(BarnesHut{Theta: 0}, ps)
+
+	for i := range exact {
+		if d := exact[i].Distance(bh[i]); d > 1e-9*exact[i].Magnitude() {
+			t.Errorf(`particle %d: exact %s, barnes-hut %s`, i, exact[i], bh[i])
+		}
+	}
+}
+
+func TestBarnesHutApproximation(t *testing.T) {
+	ps := randomParticles(1000, 2)
+
+	exact := accelerations(Pairwise{}, ps)
+	bh := accelerations(BarnesHut{Theta: 0.5}, ps)
+
+	errSum := 0.0
+	for i := range exact {
+		errSum += exact[i].Distance(bh[i]) / exact[i].Magnitude()
+	}
+
+	if e := errSum / float64(len(ps)); e > 0.01 {
+		t.Errorf(`mean relative error %f is too large`, e)
+	}
+}
+
+func TestBarnesHutCoincident(t *testing.T) {
+	ps := []*Particle{
+		newParticle(2, vector.V3{}, vector.V3{}),
+		newParticle(2, vector.V3{}, vector.V3{}),
+		newParticle(2, vector.V3{X: 10}, vector.V3{}),
+	}
+
+	exact := accelerations(Pairwise{}, ps)
+	bh := accelerations(BarnesHut{Theta: 0.5}, ps)
+
+	for i := range exact {
+		if d := exact[i].Distance(bh[i]); d > 1e-9 {
+			t.Errorf(`particle %d: exact %s, barnes-hut %s`, i, exact[i], bh[i])
+		}
+	}
+}
+
+func TestKernelSoftening(t *testing.T) {
+	for _, s := range []Softening{SOFTEN_PLUMMER, SOFTEN_SPLINE} {
+		k := kernel{G: 0.5, Epsilon: 2, Softening: s}
+
+		// The acceleration towards the other mass is the slope of the potential
+		for d := 0.1; d < 20; d += 0.1 {
+			h := 1e-6
+			f := (k.potential(1, 1, d+h) - k.potential(1, 1, d-h)) / (2 * h)
+			a := k.accel(vector.V3{}, 1, vector.V3{X: d}).X
+			if math.Abs(f-a) > 1e-6*math.Abs(a) {
+				t.Errorf(`%s: at distance %f, force %g doesn't match the potential's %g`, s, d, a, f)
+			}
+		}
+
+		// Far away, gravity is Newtonian again
+		d := 100 * k.Epsilon
+		a := k.accel(vector.V3{}, 1, vector.V3{X: d}).X
+		if n := k.G / (d * d); math.Abs(a-n) > 1e-3*n {
+			t.Errorf(`%s: expected %g at distance %f, got %g`, s, n, d, a)
+		}
+	}
+
+	// Beyond its support, the spline kernel is exact
+	k := kernel{G: 0.5, Epsilon: 1, Softening: SOFTEN_SPLINE}
+	if a, n := k.accel(vector.V3{}, 2, vector.V3{Y: 3}).Y, k.G*2/9; a != n {
+		t.Errorf(`expected %g beyond the spline kernel, got %g`, n, a)
+	}
+
+	// Without softening, coincident particles don't attract each other
+	if a := testKernel.accel(vector.V3{X: 1}, 1, vector.V3{X: 1}); a != (vector.V3{}) {
+		t.Errorf(`expected no acceleration between coincident particles, got %s`, a)
+	}
+}
+
+func TestKeplerOrbit(t *testing.T) {
+	// Two bodies on an eccentric orbit, starting at apocentre
+	m1, m2 := 3.0, 1.0
+	a, e := 20.0, 0.5
+	gm := testKernel.G * (m1 + m2)
+
+	ra := a * (1 + e)
+	va := math.Sqrt(gm / a * (1 - e) / (1 + e))
+	period := 2 * math.Pi * math.Sqrt(a*a*a/gm)
+
+	ps := []*Particle{
+		newParticle(m1, vector.V3{X: -ra * m2 / (m1 + m2)}, vector.V3{Y: -va * m2 / (m1 + m2)}),
+		newParticle(m2, vector.V3{X: ra * m1 / (m1 + m2)}, vector.V3{Y: va * m1 / (m1 + m2)}),
+	}
+	s := newParticleStore(ps)
+
+	steps := 4000
+	peri := math.Inf(1)
+	for i := 0; i < steps; i++ {
+		RK4{}.step(pairwise(s), s, period/float64(steps))
+		peri = math.Min(peri, s.pos[0].Distance(s.pos[1]))
+	}
+
+	if rp := a * (1 - e); math.Abs(peri-rp) > 1e-3*rp {
+		t.Errorf(`expected pericentre at %f, got %f`, rp, peri)
+	}
+
+	// After one period, both bodies are back where they started
+	for i, p := range ps {
+		if d := s.pos[i].Distance(p.Pos); d > 1e-3*a {
+			t.Errorf(`particle %d: expected to return to %s after one period, got %s`, i, p.Pos, s.pos[i])
+		}
+	}
+}
+
+// channelPairwise is the pairwise solver as it was before the worker
+// pool: every pair is sent to one of four goroutines that are started on
+// every call, and the particles are locked while their accelerations are
+// updated. It is kept as the baseline for the benchmarks.
+func channelPairwise(k kernel, ps []*Particle, pos []vector.V3, acc []vector.V3) {
+	for i := range acc {
+		acc[i] = vector.V3{}
+	}
+
+	locks := make([]sync.Mutex, len(ps))
+	pchan := make(chan [2]int)
+	wg := sync.WaitGroup{}
+	gw := func() {
+		for p := range pchan {
+			i, j := p[0], p[1]
+
+			locks[i].Lock()
+			locks[j].Lock()
+			acc[i] = acc[i].Add(k.accel(pos[i], ps[j].M, pos[j]))
+			acc[j] = acc[j].Add(k.accel(pos[j], ps[i].M, pos[i]))
+			locks[j].Unlock()
+			locks[i].Unlock()
+
+			wg.Done()
+		}
+	}
+	for i := 0; i < 4; i++ {
+		go gw()
+	}
+
+	for i := range ps {
+		for j := i + 1; j < len(ps); j++ {
+			wg.Add(1)
+			pchan <- [2]int{i, j}
+		}
+	}
+	wg.Wait()
+	close(pchan)
+}
+
+func TestPairwiseWorkers(t *testing.T) {
+	ps := randomParticles(300, 4)
+	pos := positions(ps)
+
+	ref := make([]vector.V3, len(ps))
+	channelPairwise(testKernel, ps, pos, ref)
+
+	for _, n := range []int{1, 2, 3, 7, 16} {
+		wp := newWorkerPool(n)
+
+		acc := make([]vector.V3, len(ps))
+		Pairwise{}.accelerate(wp, testKernel, masses(ps), pos, nil, acc)
+		for i := range ref {
+			if d := ref[i].Distance(acc[i]); d > 1e-9*ref[i].Magnitude() {
+				t.Errorf(`%d workers, particle %d: expected %s, got %s`, n, i, ref[i], acc[i])
+			}
+		}
+
+		// Every item is handed out exactly once
+		next := 0
+		for w := 0; w < n; w++ {
+			lo, hi := wp.span(len(ps), w)
+			if lo != next || hi < lo {
+				t.Errorf(`%d workers: worker %d got items %d to %d after %d`, n, w, lo, hi, next)
+			}
+			next = hi
+		}
+		if next != len(ps) {
+			t.Errorf(`%d workers: items end at %d instead of %d`, n, next, len(ps))
+		}
+
+		wp.close()
+	}
+}
+
+// TestGravityWorkerCount checks that the accelerations are bit for bit the
+// same for any number of workers, so that runs are reproducible on machines
+// with a different number of CPUs.
+func TestGravityWorkerCount(t *testing.T) {
+	ps := randomParticles(300, 5)
+	m, pos := masses(ps), positions(ps)
+
+	for _, g := range []Gravity{Pairwise{}, BarnesHut{Theta: 0.5}} {
+		var ref []vector.V3
+		for _, n := range []int{1, 2, 3, 8} {
+			wp := newWorkerPool(n)
+			acc := make([]vector.V3, len(ps))
+			g.accelerate(wp, testKernel, m, pos, nil, acc)
+			wp.close()
+
+			if ref == nil {
+				ref = acc
+				continue
+			}
+
+			diff := 0
+			for i := range ref {
+				if acc[i] != ref[i] {
+					diff++
+				}
+			}
+			if diff != 0 {
+				t.Errorf(`%s: %d of %d accelerations differ between 1 and %d workers`, g, diff, len(ps), n)
+			}
+		}
+	}
+}
+
+func benchmarkGravity(b *testing.B, g Gravity, n int) {
+	ps := randomParticles(n, 3)
+	m, pos := masses(ps), positions(ps)
+	acc := make([]vector.V3, n)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.accelerate(testPool, testKernel, m, pos, nil, acc)
+	}
+}
+
+func BenchmarkPairwiseChannels1000(b *testing.B) {
+	ps := randomParticles(1000, 3)
+	pos := positions(ps)
+	acc := make([]vector.V3, len(ps))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		channelPairwise(testKernel, ps, pos, acc)
+	}
+}
+
+func BenchmarkPairwise1000(b *testing.B)   { benchmarkGravity(b, Pairwise{}, 1000) }
+func BenchmarkBarnesHut1000(b *testing.B)  { benchmarkGravity(b, BarnesHut{Theta: 0.5}, 1000) }
+func BenchmarkBarnesHut10000(b *testing.B) { benchmarkGravity(b, BarnesHut{Theta: 0.5}, 10000) }
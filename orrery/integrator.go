@@ -0,0 +1,269 @@
+package orrery
+
+import (
+	"fmt"
+	"math"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// accelFunc computes the accelerations acc of the particles with the indices
+// in active, or of all particles if active is nil, if they were at the
+// positions pos. The accelerations of the other particles are left alone.
+type accelFunc func(pos []vector.V3, active []int, acc []vector.V3)
+
+// Integrator advances particle positions and velocities by one time step.
+type Integrator interface {
+	fmt.Stringer
+
+	// step advances the positions and velocities of the particles in s in
+	// place by dt, using accel to compute their accelerations.
+	step(accel accelFunc, s *particleStore, dt float64)
+}
+
+// Euler is the semi-implicit Euler method: velocities are updated first and
+// then used to move the particles. It is cheap but only first order.
+type Euler struct{}
+
+func (Euler) String() string { return "euler" }
+
+func (Euler) step(accel accelFunc, s *particleStore, dt float64) {
+	pos, vel := s.pos, s.vel
+	acc := make([]vector.V3, len(pos))
+	accel(pos, nil, acc)
+
+	for i := range pos {
+		vel[i] = vel[i].Add(acc[i].Scaled(dt))
+		pos[i] = pos[i].Add(vel[i].Scaled(dt))
+	}
+}
+
+// Leapfrog is the symplectic drift-kick-drift leapfrog method. It needs one
+// gravity evaluation per step and keeps the energy of orbits bounded.
+type Leapfrog struct{}
+
+func (Leapfrog) String() string { return "leapfrog" }
+
+func (Leapfrog) step(accel accelFunc, s *particleStore, dt float64) {
+	pos, vel := s.pos, s.vel
+	acc := make([]vector.V3, len(pos))
+
+	for i := range pos {
+		pos[i] = pos[i].Add(vel[i].Scaled(dt / 2))
+	}
+
+	accel(pos, nil, acc)
+
+	for i := range pos {
+		vel[i] = vel[i].Add(acc[i].Scaled(dt))
+		pos[i] = pos[i].Add(vel[i].Scaled(dt / 2))
+	}
+}
+
+// VelocityVerlet is the symplectic velocity Verlet method. Unlike Leapfrog,
+// positions and velocities are in sync at the end of every step, at the cost
+// of a second gravity evaluation.
+type VelocityVerlet struct{}
+
+func (VelocityVerlet) String() string { return "verlet" }
+
+func (VelocityVerlet) step(accel accelFunc, s *particleStore, dt float64) {
+	pos, vel := s.pos, s.vel
+	acc := make([]vector.V3, len(pos))
+	accel(pos, nil, acc)
+
+	for i := range pos {
+		pos[i] = pos[i].Add(vel[i].Scaled(dt)).Add(acc[i].Scaled(dt * dt / 2))
+		vel[i] = vel[i].Add(acc[i].Scaled(dt / 2))
+	}
+
+	accel(pos, nil, acc)
+
+	for i := range pos {
+		vel[i] = vel[i].Add(acc[i].Scaled(dt / 2))
+	}
+}
+
+// RK4 is the classical fourth order Runge-Kutta method. It is very accurate
+// for short runs, but not symplectic, so energy drifts over long runs.
+type RK4 struct{}
+
+func (RK4) String() string { return "rk4" }
+
+func (RK4) step(accel accelFunc, s *particleStore, dt float64) {
+	pos, vel := s.pos, s.vel
+	n := len(pos)
+
+	// k*x are the derivatives of the positions, k*v those of the velocities
+	k1x, k1v := make([]vector.V3, n), make([]vector.V3, n)
+	k2x, k2v := make([]vector.V3, n), make([]vector.V3, n)
+	k3x, k3v := make([]vector.V3, n), make([]vector.V3, n)
+	k4x, k4v := make([]vector.V3, n), make([]vector.V3, n)
+	tmp := make([]vector.V3, n)
+
+	copy(k1x, vel)
+	accel(pos, nil, k1v)
+
+	for i := range pos {
+		tmp[i] = pos[i].Add(k1x[i].Scaled(dt / 2))
+		k2x[i] = vel[i].Add(k1v[i].Scaled(dt / 2))
+	}
+	accel(tmp, nil, k2v)
+
+	for i := range pos {
+		tmp[i] = pos[i].Add(k2x[i].Scaled(dt / 2))
+		k3x[i] = vel[i].Add(k2v[i].Scaled(dt / 2))
+	}
+	accel(tmp, nil, k3v)
+
+	for i := range pos {
+		tmp[i] = pos[i].Add(k3x[i].Scaled(dt))
+		k4x[i] = vel[i].Add(k3v[i].Scaled(dt))
+	}
+	accel(tmp, nil, k4v)
+
+	for i := range pos {
+		dx := k1x[i].Add(k2x[i].Scaled(2)).Add(k3x[i].Scaled(2)).Add(k4x[i])
+		dv := k1v[i].Add(k2v[i].Scaled(2)).Add(k3v[i].Scaled(2)).Add(k4v[i])
+
+		pos[i] = pos[i].Add(dx.Scaled(dt / 6))
+		vel[i] = vel[i].Add(dv.Scaled(dt / 6))
+	}
+}
+
+// BlockLeapfrog is a kick-drift-kick leapfrog with block time steps. Each
+// tick, every particle gets a step of dt/2^k, with k chosen so that the step
+// is below Eta * sqrt(Length / |a|), capped at MaxLevel. Particles in close
+// encounters are thus integrated with small steps while the rest of the
+// system keeps the full tick length.
+//
+// At every substep, only the particles whose step ends there get new
+// accelerations. The accelerations at the end of a tick are kept for the
+// start of the next one, so the particles with the full tick length cost a
+// single force evaluation per tick.
+//
+// The step size and an estimate of the local position error of every
+// particle are recorded and can be read with Particle.StepError.
+type BlockLeapfrog struct {
+	Eta      float64
+	Length   float64
+	MaxLevel int
+}
+
+func (BlockLeapfrog) String() string { return "block-leapfrog" }
+
+func (b BlockLeapfrog) level(a vector.V3, dt float64) int {
+	am := a.Magnitude()
+	if am == 0 {
+		return 0
+	}
+
+	h := b.Eta * math.Sqrt(b.Length/am)
+	k := math.Ceil(math.Log2(dt / h))
+	if math.IsNaN(k) {
+		// From a NaN acceleration or invalid parameters, which smaller
+		// steps don't help with
+		return 0
+	}
+
+	return int(math.Max(0, math.Min(float64(b.MaxLevel), k)))
+}
+
+func (b BlockLeapfrog) step(accel accelFunc, s *particleStore, dt float64) {
+	pos, vel := s.pos, s.vel
+	n := len(pos)
+
+	acc := make([]vector.V3, n)
+	if s.endAcc.valid(s) {
+		copy(acc, s.endAcc.acc)
+	} else {
+		accel(pos, nil, acc)
+	}
+
+	levels := make([]int, n)
+	maxLevel := 0
+	for i := range pos {
+		levels[i] = b.level(acc[i], dt)
+		if levels[i] > maxLevel {
+			maxLevel = levels[i]
+		}
+	}
+
+	substeps := 1 << uint(maxLevel)
+	h := dt / float64(substeps)
+
+	// stride is the number of substeps that make up one step of particle i
+	stride := func(i int) int {
+		return 1 << uint(maxLevel-levels[i])
+	}
+
+	start := make([]vector.V3, n) // acceleration at the beginning of the current step
+	errs := make([]float64, n)
+	active := make([]int, 0, n) // particles whose step ends at the current substep
+
+	for sub := 0; sub < substeps; sub++ {
+		for i := range pos {
+			if sub%stride(i) == 0 {
+				hi := h * float64(stride(i))
+				vel[i] = vel[i].Add(acc[i].Scaled(hi / 2))
+				start[i] = acc[i]
+			}
+		}
+
+		for i := range pos {
+			pos[i] = pos[i].Add(vel[i].Scaled(h))
+		}
+
+		active = active[:0]
+		for i := range pos {
+			if (sub+1)%stride(i) == 0 {
+				active = append(active, i)
+			}
+		}
+
+		accel(pos, active, acc)
+
+		for _, i := range active {
+			hi := h * float64(stride(i))
+			vel[i] = vel[i].Add(acc[i].Scaled(hi / 2))
+			errs[i] = math.Max(errs[i], acc[i].Sub(start[i]).Magnitude()*hi*hi/2)
+		}
+	}
+
+	for i := range pos {
+		s.dt[i] = h * float64(stride(i))
+		s.stepErr[i] = errs[i]
+	}
+
+	// Every particle's step ends at the last substep, so acc holds the
+	// accelerations at the current positions
+	s.endAcc.set(s, acc)
+}
+
+// accelCache holds accelerations together with the positions and masses
+// they were computed from. They can be reused as long as neither changed,
+// which doesn't hold after collisions or edits between two ticks.
+type accelCache struct {
+	acc []vector.V3
+	pos []vector.V3
+	m   []float64
+}
+
+func (c *accelCache) set(s *particleStore, acc []vector.V3) {
+	c.acc = append(c.acc[:0], acc...)
+	c.pos = append(c.pos[:0], s.pos...)
+	c.m = append(c.m[:0], s.m...)
+}
+
+// valid returns whether the accelerations belong to the particles of s.
+func (c *accelCache) valid(s *particleStore) bool {
+	if len(c.pos) != s.len() {
+		return false
+	}
+	for i := range c.pos {
+		if c.pos[i] != s.pos[i] || c.m[i] != s.m[i] {
+			return false
+		}
+	}
+	return true
+}
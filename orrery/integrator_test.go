@@ -0,0 +1,203 @@
+package orrery
+
+import (
+	"math"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// twoBody returns two equal particles in a circular orbit around their
+// common centre of mass.
+func twoBody() []*Particle {
+	r := 10.0
+	m := 1.0
+	// Each particle is pulled towards the other one at distance 2r
+	a := testKernel.G * m / (4 * r * r)
+	v := math.Sqrt(a * r)
+
+	return []*Particle{
+		newParticle(m, vector.V3{X: -r}, vector.V3{Y: -v}),
+		newParticle(m, vector.V3{X: r}, vector.V3{Y: v}),
+	}
+}
+
+func twoBodyEnergy(s *particleStore) float64 {
+	e := 0.0
+	for i, m := range s.m {
+		e += m * s.vel[i].Dot(s.vel[i]) / 2
+	}
+
+	return e - testKernel.G*s.m[0]*s.m[1]/s.pos[0].Distance(s.pos[1])
+}
+
+func runIntegrator(in Integrator, steps int) (e0, drift float64) {
+	s := newParticleStore(twoBody())
+
+	e0 = twoBodyEnergy(s)
+	for i := 0; i < steps; i++ {
+		in.step(pairwise(s), s, 1)
+		drift = math.Max(drift, math.Abs(twoBodyEnergy(s)-e0))
+	}
+
+	return e0, drift / math.Abs(e0)
+}
+
+func TestIntegratorEnergy(t *testing.T) {
+	// Roughly ten orbits
+	steps := 4000
+
+	for _, tc := range []struct {
+		in       Integrator
+		maxDrift float64
+	}{
+		{Leapfrog{}, 1e-3},
+		{VelocityVerlet{}, 1e-3},
+		{RK4{}, 1e-3},
+	} {
+		_, drift := runIntegrator(tc.in, steps)
+		if drift > tc.maxDrift {
+			t.Errorf(`%T: relative energy drift %g exceeds %g`, tc.in, drift, tc.maxDrift)
+		}
+	}
+}
+
+func TestIntegratorEulerDrifts(t *testing.T) {
+	_, euler := runIntegrator(Euler{}, 4000)
+	_, leapfrog := runIntegrator(Leapfrog{}, 4000)
+
+	if euler <= leapfrog {
+		t.Errorf(`expected euler (%g) to drift more than leapfrog (%g)`, euler, leapfrog)
+	}
+}
+
+// encounter returns two particles on an eccentric orbit with a close
+// pericentre passage.
+func encounter() []*Particle {
+	return []*Particle{
+		newParticle(1, vector.V3{X: -20}, vector.V3{Y: -0.02}),
+		newParticle(1, vector.V3{X: 20}, vector.V3{Y: 0.02}),
+	}
+}
+
+func TestBlockLeapfrogEncounter(t *testing.T) {
+	drift := func(in Integrator) float64 {
+		s := newParticleStore(encounter())
+
+		e0 := twoBodyEnergy(s)
+		d := 0.0
+		for i := 0; i < 1000; i++ {
+			in.step(pairwise(s), s, 1)
+			d = math.Max(d, math.Abs(twoBodyEnergy(s)-e0))
+		}
+		return d / math.Abs(e0)
+	}
+
+	fixed := drift(Leapfrog{})
+	adaptive := drift(BlockLeapfrog{Eta: 0.05, Length: 1, MaxLevel: 8})
+
+	if adaptive*10 > fixed {
+		t.Errorf(`expected adaptive drift (%g) to be much smaller than fixed drift (%g)`, adaptive, fixed)
+	}
+}
+
+func TestBlockLeapfrogStepError(t *testing.T) {
+	s := newParticleStore(append(encounter(), newParticle(1, vector.V3{X: 1000}, vector.V3{})))
+	for i := range s.vel {
+		s.vel[i] = vector.V3{}
+	}
+
+	// Move the pair close together, the lone particle far away stays slow
+	s.pos[0], s.pos[1] = vector.V3{X: -1.5}, vector.V3{X: 1.5}
+
+	BlockLeapfrog{Eta: 0.05, Length: 1, MaxLevel: 8}.step(pairwise(s), s, 1)
+
+	dtClose, errClose := s.particle(0).StepError()
+	dtFar, _ := s.particle(2).StepError()
+
+	if dtClose >= dtFar {
+		t.Errorf(`expected close particle step %g to be below far particle step %g`, dtClose, dtFar)
+	}
+	if dtFar != 1 {
+		t.Errorf(`expected far particle to take the full step, got %g`, dtFar)
+	}
+	if errClose == 0 {
+		t.Errorf(`expected a non-zero error estimate`)
+	}
+}
+
+func TestBlockLeapfrogActiveParticles(t *testing.T) {
+	// A close pair and a ring of slow particles far away
+	ps := encounter()
+	ps[0].Pos, ps[1].Pos = vector.V3{X: -1.5}, vector.V3{X: 1.5}
+	for i := 0; i < 20; i++ {
+		a := 2 * math.Pi * float64(i) / 20
+		ps = append(ps, newParticle(1, vector.V3{X: 1000 * math.Cos(a), Y: 1000 * math.Sin(a)}, vector.V3{}))
+	}
+	s := newParticleStore(ps)
+
+	evals := 0
+	inner := pairwise(s)
+	accel := func(pos []vector.V3, active []int, acc []vector.V3) {
+		evals += activeCount(active, len(pos))
+		inner(pos, active, acc)
+	}
+
+	b := BlockLeapfrog{Eta: 0.05, Length: 1, MaxLevel: 8}
+	b.step(accel, s, 1)
+
+	// Only the pair takes the small steps, the ring needs one evaluation
+	// for the start and one for the end of its single step
+	dt, _ := s.particle(0).StepError()
+	substeps := int(math.Round(1 / dt))
+	if substeps < 2 {
+		t.Fatalf(`expected the pair to take substeps, got a step of %g`, dt)
+	}
+	if max := len(ps) + 2*substeps + 20; evals > max {
+		t.Errorf(`expected at most %d particle accelerations, got %d`, max, evals)
+	}
+
+	// The next tick starts from the accelerations at the end of this one
+	evals = 0
+	b.step(accel, s, 1)
+	dt, _ = s.particle(0).StepError()
+	if max := 2*int(math.Round(1/dt)) + 20; evals > max {
+		t.Errorf(`expected at most %d particle accelerations in the second tick, got %d`, max, evals)
+	}
+
+	// Unless the particles changed in between
+	evals = 0
+	s.m[2] *= 2
+	b.step(accel, s, 1)
+	if evals < len(ps) {
+		t.Errorf(`expected all particles to be evaluated after a change, got %d`, evals)
+	}
+}
+
+func TestBlockLeapfrogCachedAccelerations(t *testing.T) {
+	// Reusing the accelerations of the last tick gives the same results as
+	// computing them again
+	cached, fresh := newParticleStore(encounter()), newParticleStore(encounter())
+	b := BlockLeapfrog{Eta: 0.05, Length: 1, MaxLevel: 8}
+	for i := 0; i < 10; i++ {
+		b.step(pairwise(cached), cached, 1)
+		b.step(pairwise(fresh), fresh, 1)
+		fresh.endAcc = accelCache{}
+	}
+	samePositions(t, cached.particles(), fresh.particles())
+}
+
+func TestBlockLeapfrogLevel(t *testing.T) {
+	b := BlockLeapfrog{Eta: 0.05, Length: 1, MaxLevel: 8}
+	if l := b.level(vector.V3{X: math.NaN()}, 1); l != 0 {
+		t.Errorf(`expected level 0 for a NaN acceleration, got %d`, l)
+	}
+	b.Length = -1
+	if l := b.level(vector.V3{X: 1}, 1); l != 0 {
+		t.Errorf(`expected level 0 for a negative length, got %d`, l)
+	}
+	b.Length = 1
+	if l := b.level(vector.V3{X: 1e10}, 1); l != 8 {
+		t.Errorf(`expected level 8 for a large acceleration, got %d`, l)
+	}
+}
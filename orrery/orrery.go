@@ -1,19 +1,21 @@
 package orrery
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.c3pb.de/farhaven/universe/vector"
 )
 
 type Particle struct {
+	ID  uint64 // unique within an orrery, 0 until the particle is added to one
 	T   float64
 	R   float64
 	M   float64
@@ -22,74 +24,303 @@ type Particle struct {
 
 	Trail []vector.V3
 
-	L sync.Mutex
+	dt      float64 // step size of the last tick, only set by adaptive integrators
+	stepErr float64 // estimated local position error of the last tick
 }
 
 type command interface{}
+
+var (
+	// ErrQueueFull is returned by TryQueueCommand if the command queue is
+	// full.
+	ErrQueueFull = errors.New(`command queue is full`)
+
+	// ErrClosed is the result of commands queued after Close.
+	ErrClosed = errors.New(`orrery is closed`)
+
+	// ErrNotPaused is the result of CommandStep while the simulation is
+	// running.
+	ErrNotPaused = errors.New(`can't step while the simulation is running`)
+)
+
+// Reply is the result of a queued command. It is resolved once the
+// simulation loop has handled the command, or rejected it.
+type Reply struct {
+	done chan struct{}
+	err  error
+}
+
+func newReply() *Reply {
+	return &Reply{done: make(chan struct{})}
+}
+
+func (r *Reply) resolve(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// Done returns a channel that is closed once the command has been handled.
+func (r *Reply) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait blocks until the command has been handled and returns the error it
+// failed with, if any.
+func (r *Reply) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// queuedCommand is a command on its way to the simulation loop.
+type queuedCommand struct {
+	c     command
+	reply *Reply
+}
 type CommandSpawnParticle struct {
 	Pos vector.V3
+	Vel vector.V3
 	M   float64
 }
+
+// CommandSpawnOrbit spawns a particle of mass M at Pos, with the velocity
+// of a circular orbit around the particle with the ID Parent. The orbit
+// lies in the plane perpendicular to Normal, or the XY plane if Normal is
+// zero.
+type CommandSpawnOrbit struct {
+	Parent uint64
+	Pos    vector.V3
+	M      float64
+	Normal vector.V3
+}
 type CommandSpawnVolume struct {
 	Pos vector.V3
 }
 type CommandPause struct{}
-type CommandLoad struct{}
-type CommandStore struct{}
+
+// CommandSpeedUp doubles the number of ticks simulated per wall-clock step.
+type CommandSpeedUp struct{}
+
+// CommandSlowDown halves the number of ticks simulated per wall-clock step.
+type CommandSlowDown struct{}
+
+// CommandStep runs N ticks (at least one) while the orrery is paused. While
+// the simulation is running, it fails with ErrNotPaused.
+type CommandStep struct {
+	N int
+}
+
+// CommandLoad replaces the universe with the snapshot in the file Path. The
+// format is chosen by its extension, see LoadSnapshot. An empty Path loads
+// the configured universe file.
+type CommandLoad struct {
+	Path string
+}
+
+// CommandStore writes a snapshot of the universe to the file Path. An empty
+// Path stores to the configured universe file.
+type CommandStore struct {
+	Path string
+}
+
+// CommandRewind moves the simulation N frames back in the rewind buffer, or
+// forward for negative N, and pauses it. Simulating from an earlier frame
+// forks the run and discards the frames after it.
+type CommandRewind struct {
+	N int
+}
+
+// CommandGenerate adds the particles created by Generator, shifted by Pos
+// and Vel. A Seed of 0 uses the random number generator of the orrery.
+type CommandGenerate struct {
+	Generator Generator
+	Seed      int64
+	Pos       vector.V3
+	Vel       vector.V3
+}
+
+// CommandDelete removes the particle with the given ID.
+type CommandDelete struct {
+	ID uint64
+}
+
+// CommandEdit changes the particle with the given ID. Fields that are nil
+// are left alone. The radius follows the mass.
+type CommandEdit struct {
+	ID  uint64
+	M   *float64
+	Pos *vector.V3
+	Vel *vector.V3
+}
+
 type Orrery struct {
-	particles   []*Particle
+	cfg         Config // configuration the orrery was created with
+	particles   *particleStore
 	trailLength int
-	q           chan bool
+	q           chan struct{} // closed to stop the loop
+	done        chan struct{} // closed when the loop has stopped
+	closeErr    error         // result of shutting down, see Close
 	l           sync.Mutex
-	c           chan command
+	c           chan queuedCommand
+	cl          sync.RWMutex // held for reading while queueing to c
+	closed      bool         // guarded by cl
 	looptime    time.Duration
+	gravity     Gravity
+	kernel      kernel
+	pool        *workerPool
+	integrator  Integrator
+	collisions  CollisionPolicy
+	restitution float64
+	universe    string // default file name for CommandLoad and CommandStore
+	seed        int64
+	rng         *rand.Rand // guarded by o.l
+	rand        *rngSource // source of rng
+	nextID      uint64     // last particle ID handed out
 	Paused      bool
+	frame       atomic.Value // *Frame, see publish
+	frames      []*Frame     // all frames, for reuse
+	dirty       bool         // state changed since the last frame was published
+
+	dt           float64 // simulated time per tick
+	time         float64 // simulated time since the start of the run
+	ticks        uint64
+	epoch        float64 // time at epochTick, see setClock
+	epochTick    uint64
+	timeScale    float64 // ticks per loop iteration
+	tickBudget   float64 // fractional ticks left over from previous iterations
+	pendingTicks int     // ticks requested by CommandStep while paused
+
+	prevPos []vector.V3 // positions before the current tick, for the trails
+
+	diagnosticsInterval int
+	driftThreshold      float64
+	history             []Diagnostics
+	reference           *Diagnostics // diagnostics drift is measured against, reset when particles are changed
+	drifting            bool
+
+	recorder *recorder
+
+	rewind         *rewindBuffer // nil if rewinding is disabled
+	rewindInterval int
+}
+
+// Config holds the parameters an Orrery is created with.
+type Config struct {
+	Gravity    Gravity
+	G          float64 // gravitational constant
+	Integrator Integrator
+	Dt         float64
+	LoopTime   time.Duration // wall-clock time per loop iteration
+
+	// Number of goroutines that compute gravity, 0 uses GOMAXPROCS. The
+	// results don't depend on it.
+	Workers int
+
+	// Gravity is softened below the distance Epsilon, 0 disables softening
+	Epsilon   float64
+	Softening Softening
+
+	Collisions CollisionPolicy
+	// Coefficient of restitution for bouncing collisions. The remaining
+	// energy is turned into heat.
+	Restitution float64
+
+	TrailLength int
+	Universe    string // default file name for CommandLoad and CommandStore
+	Seed        int64  // seed of the random number generator, 0 picks one
+
+	// Conserved quantities are recorded every DiagnosticsInterval ticks,
+	// or never if it is 0. A warning is logged when their relative drift
+	// exceeds DriftThreshold.
+	DiagnosticsInterval int
+	DriftThreshold      float64
+
+	// Every RewindInterval ticks, the state is added to a rewind buffer
+	// that holds the last RewindLength of them. A length of 0 disables
+	// rewinding.
+	RewindLength   int
+	RewindInterval int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Gravity:    Pairwise{},
+		G:          UNITS_SIMULATION.G,
+		Integrator: Leapfrog{},
+		Dt:         1,
+		LoopTime:   5 * time.Millisecond,
+
+		Epsilon:   1,
+		Softening: SOFTEN_PLUMMER,
+
+		Collisions:  COLLIDE_BOUNCE,
+		Restitution: 0.5,
+
+		TrailLength: 20,
+		Universe:    "universe.json",
+
+		DiagnosticsInterval: 100,
+		DriftThreshold:      0.01,
+
+		RewindLength:   100,
+		RewindInterval: 10,
+	}
 }
 
+const (
+	minTimeScale = 1.0 / 64
+	maxTimeScale = 64
+)
+
+// Particles returns copies of all particles.
 func (o *Orrery) Particles() []*Particle {
 	o.l.Lock()
 	defer o.l.Unlock()
 
-	r := make([]*Particle, len(o.particles))
-	copy(r, o.particles)
-
-	return r
+	return o.particles.particles()
 }
 
-func (p *Particle) String() string {
-	return fmt.Sprintf(`T: %0.2f R:%.2f, M:%.2f, Pos:%s, Vel:%s`, p.T, p.R, p.M, p.Pos, p.Vel)
+// Time returns the simulated time since the start of the run.
+func (o *Orrery) Time() float64 {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	return o.time
 }
 
-func (p *Particle) move(trailLength int) {
-	p.L.Lock()
-	defer p.L.Unlock()
+// Ticks returns the number of simulation steps since the start of the run.
+func (o *Orrery) Ticks() uint64 {
+	o.l.Lock()
+	defer o.l.Unlock()
 
-	newPos := p.Pos.Add(p.Vel)
+	return o.ticks
+}
 
-	addToTrail := false
+// Dt returns the simulated time per tick. It doesn't change after New.
+func (o *Orrery) Dt() float64 {
+	return o.dt
+}
 
-	if len(p.Trail) > 0 {
-		d := newPos.Distance(p.Trail[len(p.Trail)-1])
+// TimeScale returns the number of ticks simulated per wall-clock step.
+func (o *Orrery) TimeScale() float64 {
+	o.l.Lock()
+	defer o.l.Unlock()
 
-		if d > p.R {
-			addToTrail = true
-		}
-	} else {
-		addToTrail = true
-	}
+	return o.timeScale
+}
 
-	if addToTrail {
-		p.Trail = append(p.Trail, p.Pos)
-		if len(p.Trail) > trailLength {
-			p.Trail = p.Trail[len(p.Trail)-trailLength:]
-		}
+func (p *Particle) String() string {
+	s := fmt.Sprintf(`ID: %d, T: %0.2f R:%.2f, M:%.2f, Pos:%s, Vel:%s`, p.ID, p.T, p.R, p.M, p.Pos, p.Vel)
+	if p.dt != 0 {
+		s += fmt.Sprintf(`, dt:%.3g, err:%.2g`, p.dt, p.stepErr)
 	}
-
-	p.Pos = newPos
+	return s
 }
 
-func (p *Particle) applyForce(f vector.V3, s float64) {
-	p.Vel = p.Vel.Add(f.Scaled(s / p.M))
+// StepError returns the step size used for p during the last tick and an
+// estimate of the local position error of that step. Both are zero unless
+// the orrery uses an adaptive integrator.
+func (p *Particle) StepError() (dt, err float64) {
+	return p.dt, p.stepErr
 }
 
 type collision int
@@ -100,246 +331,589 @@ const (
 	NONE
 )
 
-func (p *Particle) collide(px *Particle) collision {
-	if p == px {
-		panic(`can't collide with myself!`)
-	}
+// CollisionPolicy decides what happens to particles that collide.
+type CollisionPolicy int
+
+const (
+	// COLLIDE_BOUNCE makes colliding particles bounce off each other.
+	COLLIDE_BOUNCE CollisionPolicy = iota
+	// COLLIDE_MERGE merges totally overlapping particles into one and
+	// bounces partially overlapping ones.
+	COLLIDE_MERGE
+	// COLLIDE_PASS lets particles pass through each other.
+	COLLIDE_PASS
+)
 
-	if p.M == 0 || px.M == 0 {
-		panic(`colliding a particle with zero mass!`)
+func (c CollisionPolicy) String() string {
+	switch c {
+	case COLLIDE_BOUNCE:
+		return "bounce"
+	case COLLIDE_MERGE:
+		return "merge"
+	case COLLIDE_PASS:
+		return "pass"
+	default:
+		return fmt.Sprintf("CollisionPolicy(%d)", int(c))
 	}
+}
 
-	p.L.Lock()
-	defer p.L.Unlock()
+// handleCommand runs c and returns the reason it failed, if it did.
+func (o *Orrery) handleCommand(c command) error {
+	var err error
 
-	px.L.Lock()
-	defer px.L.Unlock()
+	switch c := c.(type) {
+	case CommandSpawnParticle:
+		if c.M == 0 {
+			c.M = 2
+		}
+		o.l.Lock()
+		o.addParticle(newParticle(c.M, c.Pos, c.Vel))
+		o.l.Unlock()
+	case CommandSpawnOrbit:
+		if c.M == 0 {
+			c.M = 2
+		}
+		o.l.Lock()
+		err = o.spawnOrbit(c)
+		o.l.Unlock()
+		if err != nil {
+			err = fmt.Errorf(`can't spawn orbiting particle: %s`, err)
+		}
+	case CommandSpawnVolume:
+		rn := func(r float64) float64 {
+			return (o.rng.Float64() - 0.5) * r
+		}
 
-	d := p.Pos.Distance(px.Pos)
-	if d > p.R+px.R {
-		return NONE
+		o.l.Lock()
+		for i := 0; i < 10; i++ {
+			px := vector.V3{
+				X: c.Pos.X + rn(300),
+				Y: c.Pos.Y + rn(300),
+				Z: c.Pos.Z + rn(300),
+			}
+			m := 2.0
+			o.addParticle(newParticle(m, px, vector.V3{}))
+		}
+		o.l.Unlock()
+	case CommandPause:
+		o.l.Lock()
+		o.Paused = !o.Paused
+		o.l.Unlock()
+		o.pendingTicks = 0
+	case CommandSpeedUp:
+		o.l.Lock()
+		o.timeScale = math.Min(maxTimeScale, o.timeScale*2)
+		o.l.Unlock()
+	case CommandSlowDown:
+		o.l.Lock()
+		o.timeScale = math.Max(minTimeScale, o.timeScale/2)
+		o.l.Unlock()
+	case CommandStep:
+		if !o.Paused {
+			// Steps only make sense while paused, and would run
+			// unexpectedly on the next pause otherwise
+			err = ErrNotPaused
+			break
+		}
+		if c.N < 1 {
+			c.N = 1
+		}
+		o.pendingTicks += c.N
+	case CommandRewind:
+		o.l.Lock()
+		o.rewindBy(c.N)
+		o.Paused = true
+		o.l.Unlock()
+		o.pendingTicks = 0
+	case CommandGenerate:
+		err = o.Generate(c.Generator, c.Seed, c.Pos, c.Vel)
+		if err != nil {
+			err = fmt.Errorf(`can't generate %s: %s`, c.Generator, err)
+		}
+	case CommandDelete:
+		o.l.Lock()
+		err = o.deleteParticle(c.ID)
+		o.l.Unlock()
+		if err != nil {
+			err = fmt.Errorf(`can't delete particle: %s`, err)
+		}
+	case CommandEdit:
+		o.l.Lock()
+		err = o.editParticle(c)
+		o.l.Unlock()
+		if err != nil {
+			err = fmt.Errorf(`can't edit particle: %s`, err)
+		}
+	case CommandLoad:
+		err = o.loadUniverse(c.Path)
+		if err != nil {
+			err = fmt.Errorf(`can't load universe: %s`, err)
+		}
+	case CommandStore:
+		err = o.storeUniverse(c.Path)
+		if err != nil {
+			err = fmt.Errorf(`can't store universe: %s`, err)
+		}
+	default:
+		return fmt.Errorf(`unknown orrery command: %T %v`, c, c)
 	}
 
-	CR := 0.5
+	o.l.Lock()
+	o.dirty = true
+	o.l.Unlock()
 
-	a1 := 2 * px.M / (p.M + px.M)
-	v1 := px.Vel.Sub(p.Vel)
+	return err
+}
 
-	a2 := 2 * p.M / (p.M + px.M)
-	v2 := p.Vel.Sub(px.Vel)
+// runCommand handles a queued command and returns the function that
+// resolves its reply, which is called once the result has been published.
+// Failures are logged as well, since most callers don't wait for the result.
+func (o *Orrery) runCommand(qc queuedCommand) func() {
+	err := o.handleCommand(qc.c)
+	if err != nil {
+		log.Print(err)
+	}
+	return func() {
+		qc.reply.resolve(err)
+	}
+}
 
-	p.applyForce(v1.Normalized(), a1*CR)
-	px.applyForce(v2.Normalized(), a2*CR)
+// tick advances the simulation by a single time step of length dt.
+func (o *Orrery) tick() {
+	var sample *diagnosticsSample
 
-	p.T += (a1 * (1 - CR)) / p.M
-	px.T += (a2 * (1 - CR)) / px.M
+	o.l.Lock()
 
-	if d < math.Max(p.R, px.R) {
-		return TOTAL
+	if o.rewind != nil {
+		// Simulating from an earlier frame forks the run
+		o.rewind.truncate(o.ticks)
 	}
 
-	return PARTIAL
-}
+	s := o.particles
+	o.prevPos = append(o.prevPos[:0], s.pos...)
 
-func (p *Particle) interactGravity(px *Particle) {
-	if px == p {
-		panic(`can't gravitationally interact with myself!`)
+	accel := func(pos []vector.V3, active []int, acc []vector.V3) {
+		o.gravity.accelerate(o.pool, o.kernel, s.m, pos, active, acc)
 	}
+	o.integrator.step(accel, s, o.dt)
 
-	p.L.Lock()
-	defer p.L.Unlock()
-
-	px.L.Lock()
-	defer px.L.Unlock()
+	s.updateTrails(o.prevPos, o.trailLength)
 
-	if p.M == 0 || px.M == 0 {
-		return
-	}
+	o.handleCollisions()
 
-	// G := 6.67 * math.Pow(10, -11)
-	G := float64(0.5)
+	o.ticks++
+	o.time = o.epoch + float64(o.ticks-o.epochTick)*o.dt
 
-	v := px.Pos.Sub(p.Pos)
+	if o.diagnosticsInterval > 0 && o.ticks%uint64(o.diagnosticsInterval) == 0 {
+		sample = o.sampleDiagnostics()
+	}
 
-	d := math.Max(1, v.Magnitude())
+	if o.recorder != nil && o.ticks%o.recorder.interval == 0 {
+		o.recordTrajectories()
+	}
 
-	M := p.M + px.M
-	a := (G * M) / (d * d)
+	if o.rewind != nil && o.ticks%uint64(o.rewindInterval) == 0 {
+		o.recordFrame()
+	}
 
-	v = v.Normalized()
+	o.dirty = true
+	o.l.Unlock()
 
-	p.applyForce(v, a)
-	px.applyForce(v, -a)
+	if sample != nil {
+		o.recordDiagnostics(sample)
+	}
 }
 
-func (o *Orrery) loadUniverse() {
-	fh, err := os.Open("universe.json")
-	if err != nil {
-		log.Printf(`can't open universe.json: %s`, err)
+// handleCollisions bounces or merges colliding particles according to the
+// collision policy. The caller must hold o.l.
+func (o *Orrery) handleCollisions() {
+	if o.collisions == COLLIDE_PASS {
 		return
 	}
-	defer fh.Close()
 
-	d := json.NewDecoder(fh)
+	// Broad phase: particles can only touch if they are at most
+	// 2*maxR apart, so they have to be in the same or adjacent cells.
+	s := o.particles
+	maxR := 0.0
+	for _, r := range s.r {
+		maxR = math.Max(maxR, r)
+	}
+	h := newSpatialHash(s.pos, 2*maxR)
 
-	pl := []*Particle{}
-	err = d.Decode(&pl)
-	if err != nil {
-		log.Printf(`can't decode universe: %s`, err)
-		return
+	// after returns the candidates for particle i that come after index j
+	after := func(i, j int) []int {
+		c := h.near(s.pos[i], s.r[i]+maxR)
+		k := sort.SearchInts(c, j+1)
+		return c[k:]
 	}
 
-	o.l.Lock()
-	defer o.l.Unlock()
-	o.particles = []*Particle{}
-	for _, p := range pl {
-		o.particles = append(o.particles, p)
+	garbage := make([]bool, s.len())
+	merged := false
+	for i := 0; i < s.len(); i++ {
+		if garbage[i] {
+			continue
+		}
+
+		candidates := after(i, i)
+		for k := 0; k < len(candidates); k++ {
+			j := candidates[k]
+			if garbage[j] {
+				continue
+			}
+			if s.collide(i, j, o.collisions, o.restitution) == TOTAL && o.collisions == COLLIDE_MERGE {
+				// The merged particle takes i's place and is checked
+				// against the remaining particles. It may be larger than
+				// maxR, so look for candidates again.
+				s.merge(i, j)
+				garbage[j] = true
+				merged = true
+				candidates = append(candidates[:k+1:k+1], after(i, j)...)
+			}
+		}
 	}
-}
 
-func (o *Orrery) storeUniverse() {
-	fname := "universe.json"
+	if merged {
+		s.filter(func(i int) bool { return !garbage[i] })
+	}
+}
 
-	fh, err := os.Create(fname)
-	if err != nil {
-		log.Fatalf(`can't create %s: %s`, fname, err)
+// Step synchronously simulates n ticks. It is meant for headless runs that
+// simulate as fast as possible instead of in real time, so the orrery should
+// be paused while Step is used.
+func (o *Orrery) Step(n int) {
+	for ; n > 0; n-- {
+		o.tick()
 	}
-	defer fh.Close()
+	o.publishIfDirty()
+}
 
-	e := json.NewEncoder(fh)
+// ticksDue returns how many ticks to simulate in the current loop iteration.
+func (o *Orrery) ticksDue() int {
 	o.l.Lock()
-	defer o.l.Unlock()
-	err = e.Encode(o.particles)
-	if err != nil {
-		log.Fatalf(`can't encode universe: %s`, err)
+	scale := o.timeScale
+	o.l.Unlock()
+
+	if o.Paused {
+		// Steps requested while paused run at least one tick per iteration
+		n := int(math.Max(1, scale))
+		if n > o.pendingTicks {
+			n = o.pendingTicks
+		}
+		o.pendingTicks -= n
+		return n
 	}
-	log.Printf(`dumped universe to %s`, fname)
+
+	o.tickBudget += scale
+	n := int(o.tickBudget)
+	o.tickBudget -= float64(n)
+
+	return n
 }
 
 func (o *Orrery) loop() {
-	/* XXX: Use barnes-hut simulation for less processing time: O(n^2) -> O(n log n)
-	   - https://en.wikipedia.org/wiki/Barnes%E2%80%93Hut_simulation
-	*/
+	defer close(o.done)
 
 	for {
 		t_start := time.Now()
+		reply := func() {}
 
 		select {
-		case c := <-o.c:
-			switch c := c.(type) {
-			case CommandSpawnParticle:
-				if c.M == 0 {
-					c.M = 2
-				}
-				o.particles = append(o.particles, newParticle(c.M, c.Pos, vector.V3{}))
-			case CommandSpawnVolume:
-				rn := func(r float64) float64 {
-					return (rand.Float64() - 0.5) * r
-				}
-
-				for i := 0; i < 10; i++ {
-					px := vector.V3{
-						X: c.Pos.X + rn(300),
-						Y: c.Pos.Y + rn(300),
-						Z: c.Pos.Z + rn(300),
-					}
-					m := 2.0
-					o.particles = append(o.particles, newParticle(m, px, vector.V3{}))
-				}
-			case CommandPause:
-				o.Paused = !o.Paused
-			case CommandLoad:
-				o.loadUniverse()
-			case CommandStore:
-				o.storeUniverse()
-			default:
-				panic(fmt.Sprintf(`unknown orrery command: %T %v`, c, c))
-			}
+		case <-o.q:
+			o.shutdown()
+			return
+		case qc := <-o.c:
+			reply = o.runCommand(qc)
 		default:
 		}
 
-		if o.Paused {
-			time.Sleep(o.looptime)
-			continue
+		for n := o.ticksDue(); n > 0; n-- {
+			o.tick()
 		}
 
-		pchan := make(chan [2]*Particle)
-		wg := sync.WaitGroup{}
-		gw := func() {
-			for p := range pchan {
-				p[0].interactGravity(p[1])
-				wg.Done()
-			}
-		}
-		for i := 0; i < 4; i++ {
-			go gw()
-		}
+		// A single frame per iteration, however many ticks it ran
+		o.publishIfDirty()
+		reply()
 
-		o.l.Lock()
-		for i, p := range o.particles {
-			for _, px := range o.particles[i+1:] {
-				wg.Add(1)
-				pchan <- [2]*Particle{p, px}
+		t_sleep := o.looptime.Nanoseconds() - time.Since(t_start).Nanoseconds()
+		if t_sleep > 0 {
+			select {
+			case <-o.q:
+			case <-time.After(time.Duration(t_sleep) * time.Nanosecond):
 			}
 		}
-		wg.Wait()
-		close(pchan)
+	}
+}
 
-		for _, p := range o.particles {
-			p.move(o.trailLength)
+// shutdown handles the commands that are still queued, so that a pending
+// store isn't lost, and then finishes the recording and stops the gravity
+// workers. It runs on the loop goroutine.
+func (o *Orrery) shutdown() {
+	for pending := true; pending; {
+		select {
+		case qc := <-o.c:
+			reply := o.runCommand(qc)
+			o.publishIfDirty()
+			reply()
+		default:
+			pending = false
 		}
+	}
 
-		// Check for collisions
-		garbage := make(map[*Particle]bool)
-		for i := 0; i < len(o.particles); i++ {
-			p := o.particles[i]
-			if garbage[p] {
-				continue
-			}
-			for _, px := range o.particles[i+1:] {
-				if garbage[px] {
-					continue
-				}
-				if p.collide(px) == TOTAL {
-					/*
-						// Merge p and px
-						posn := p.Pos.Add(p.Pos.Sub(px.Pos).Scaled(1.0 / 2))
-						mn := p.M + px.M
-						veln := p.Vel.Scaled(1/p.M).Add(px.Vel.Scaled(1/px.M)).Scaled(mn)
-						// TODO: calculate new average temperature from old masses and new mass
-						o.particles = append(o.particles, newParticle(mn, posn, veln))
-						// Marg p and px for garbage collection
-						garbage[p] = true
-						garbage[px] = true
-						// Restart outer loop to re-check for new collisions
-						// XXX: restarting may add additional velocity for new collisions.
-						i = 0
-						break
-					*/
-				}
-			}
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.recorder != nil {
+		o.closeErr = o.recorder.close()
+		o.recorder = nil
+	}
+	o.pool.close()
+}
+
+// Close stops the simulation. Commands queued before are still handled and a
+// running recording is flushed. Close waits until all of that is done and
+// returns the error of finishing the recording, if any. Calling it again
+// does nothing, and the orrery must not be simulated any further, but its
+// state can still be read.
+func (o *Orrery) Close() error {
+	// Waits for commands that are being queued, so that none of them is
+	// left in the queue after the loop stopped
+	o.cl.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.q)
+	}
+	o.cl.Unlock()
+
+	<-o.done
+
+	return o.closeErr
+}
+
+// QueueCommand hands c to the simulation loop, and blocks while the queue is
+// full. The returned reply is resolved once the command has been handled.
+// Unknown commands are rejected with an error, and commands queued after
+// Close with ErrClosed.
+func (o *Orrery) QueueCommand(c command) *Reply {
+	r := newReply()
+
+	o.cl.RLock()
+	defer o.cl.RUnlock()
+
+	if o.closed {
+		r.resolve(ErrClosed)
+		return r
+	}
+
+	o.c <- queuedCommand{c: c, reply: r}
+	return r
+}
+
+// TryQueueCommand is like QueueCommand, but doesn't block. It fails with
+// ErrQueueFull if the queue is full and with ErrClosed after Close.
+func (o *Orrery) TryQueueCommand(c command) (*Reply, error) {
+	r := newReply()
+
+	o.cl.RLock()
+	defer o.cl.RUnlock()
+
+	if o.closed {
+		return nil, ErrClosed
+	}
+
+	select {
+	case o.c <- queuedCommand{c: c, reply: r}:
+		return r, nil
+	default:
+		return nil, ErrQueueFull
+	}
+}
+
+// setClock sets the simulated time and the tick count. The time of later
+// ticks is computed from them instead of adding up dt, so that rounding
+// errors don't accumulate. The caller must hold o.l.
+func (o *Orrery) setClock(time float64, ticks uint64) {
+	o.time, o.ticks = time, ticks
+	o.epoch, o.epochTick = time, ticks
+}
+
+// reseed resets the random number generator to a state that only depends
+// on the seed and the current tick, so that runs continuing from the same
+// state are identical. The caller must hold o.l.
+func (o *Orrery) reseed() {
+	o.rand = newRNGSource(o.seed ^ int64(o.ticks))
+	o.rng = rand.New(o.rand)
+}
+
+// rngSource is a random number source that counts the numbers drawn from
+// it, which the sources of package rand don't expose. That is enough to
+// put a copy into the same state.
+type rngSource struct {
+	seed  int64
+	drawn uint64
+	src   rand.Source64
+}
+
+func newRNGSource(seed int64) *rngSource {
+	return &rngSource{seed: seed, src: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *rngSource) Int63() int64 {
+	s.drawn++
+	return s.src.Int63()
+}
+
+func (s *rngSource) Uint64() uint64 {
+	s.drawn++
+	return s.src.Uint64()
+}
+
+func (s *rngSource) Seed(seed int64) {
+	s.seed, s.drawn = seed, 0
+	s.src.Seed(seed)
+}
+
+// clone returns a source in the same state as s. Every number advances the
+// source by the same amount, so the numbers drawn from s are replayed.
+func (s *rngSource) clone() *rngSource {
+	c := newRNGSource(s.seed)
+	for c.drawn < s.drawn {
+		c.Uint64()
+	}
+	return c
+}
+
+// addParticle gives p a new ID and adds it to the orrery. The caller must
+// hold o.l.
+func (o *Orrery) addParticle(p *Particle) {
+	o.nextID++
+	p.ID = o.nextID
+	o.particles.add(p)
+	o.reference = nil
+}
+
+// spawnOrbit adds the particle described by c. The caller must hold o.l.
+func (o *Orrery) spawnOrbit(c CommandSpawnOrbit) error {
+	i := o.find(c.Parent)
+	if i < 0 {
+		return fmt.Errorf(`no particle with ID %d`, c.Parent)
+	}
+	r := c.Pos.Sub(o.particles.pos[i])
+	pm, pvel := o.particles.m[i], o.particles.vel[i]
+
+	d := r.Magnitude()
+	if d == 0 {
+		return errors.New(`particle would be inside its parent`)
+	}
+
+	normal := c.Normal
+	if normal == (vector.V3{}) {
+		normal = vector.V3{Z: 1}
+	}
+	dir := normal.Cross(r)
+	if dir.Magnitude() < 1e-9*normal.Magnitude()*d {
+		// r is parallel to the normal, any perpendicular direction will do
+		dir = r.Cross(vector.V3{X: 1})
+		if dir.Magnitude() < 1e-9*d {
+			dir = r.Cross(vector.V3{Y: 1})
 		}
+	}
 
-		if len(garbage) > 0 {
-			nl := []*Particle{}
-			for _, p := range o.particles {
-				if !garbage[p] {
-					nl = append(nl, p)
-				}
-			}
-			o.particles = nl
+	// The relative motion of two bodies doesn't depend on their common
+	// velocity, so the parent can keep its own
+	v := o.kernel.orbitalSpeed(c.M, pm, d)
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf(`no circular orbit with speed %f`, v)
+	}
+	vel := pvel.Add(dir.Normalized().Scaled(v))
+
+	o.addParticle(newParticle(c.M, c.Pos, vel))
+	return nil
+}
+
+// find returns the index of the particle with the given ID, or -1. The
+// caller must hold o.l.
+func (o *Orrery) find(id uint64) int {
+	for i, pid := range o.particles.id {
+		if pid == id {
+			return i
 		}
-		o.l.Unlock()
+	}
+	return -1
+}
 
-		t_sleep := o.looptime.Nanoseconds() - time.Since(t_start).Nanoseconds()
-		if t_sleep > 0 {
-			time.Sleep(time.Duration(t_sleep) * time.Nanosecond)
+// Lookup returns a copy of the particle with the given ID.
+func (o *Orrery) Lookup(id uint64) (*Particle, bool) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	i := o.find(id)
+	if i < 0 {
+		return nil, false
+	}
+	return o.particles.particle(i), true
+}
+
+// deleteParticle removes the particle with the given ID. The caller must
+// hold o.l.
+func (o *Orrery) deleteParticle(id uint64) error {
+	i := o.find(id)
+	if i < 0 {
+		return fmt.Errorf(`no particle with ID %d`, id)
+	}
+
+	o.particles.remove(i)
+	o.reference = nil
+	return nil
+}
+
+// editParticle applies c to its particle. Nothing is changed if any of the
+// new values is invalid. The caller must hold o.l.
+func (o *Orrery) editParticle(c CommandEdit) error {
+	i := o.find(c.ID)
+	if i < 0 {
+		return fmt.Errorf(`no particle with ID %d`, c.ID)
+	}
+
+	s := o.particles
+	n := Particle{T: s.t[i], R: s.r[i], M: s.m[i], Pos: s.pos[i], Vel: s.vel[i]}
+	if c.M != nil {
+		n.M = *c.M
+		if n.M > 0 {
+			n.R = math.Pow(n.M, 1.0/3)
 		}
 	}
+	if c.Pos != nil {
+		n.Pos = *c.Pos
+	}
+	if c.Vel != nil {
+		n.Vel = *c.Vel
+	}
+
+	err := n.validate()
+	if err != nil {
+		return fmt.Errorf(`particle %d: %s`, c.ID, err)
+	}
+
+	s.m[i], s.r[i], s.pos[i], s.vel[i] = n.M, n.R, n.Pos, n.Vel
+	o.reference = nil
+	return nil
 }
 
-func (o *Orrery) QueueCommand(c command) {
-	o.c <- c
+// assignIDs gives all particles without an ID a new one. The caller must
+// hold o.l.
+func (o *Orrery) assignIDs() {
+	ids := o.particles.id
+	for _, id := range ids {
+		if id > o.nextID {
+			o.nextID = id
+		}
+	}
+	for i, id := range ids {
+		if id == 0 {
+			o.nextID++
+			ids[i] = o.nextID
+		}
+	}
 }
 
 func newParticle(mass float64, pos vector.V3, vel vector.V3) *Particle {
@@ -349,14 +923,30 @@ func newParticle(mass float64, pos vector.V3, vel vector.V3) *Particle {
 	}
 }
 
-func New() *Orrery {
+func New(cfg Config) *Orrery {
 	o := &Orrery{
+		cfg:         cfg,
 		Paused:      true,
-		trailLength: 20,
-		looptime:    5 * time.Millisecond,
-
-		q: make(chan bool),
-		c: make(chan command, 20),
+		particles:   &particleStore{},
+		trailLength: cfg.TrailLength,
+		looptime:    cfg.LoopTime,
+		gravity:     cfg.Gravity,
+		kernel:      kernel{G: cfg.G, Epsilon: cfg.Epsilon, Softening: cfg.Softening},
+		pool:        newWorkerPool(cfg.Workers),
+		integrator:  cfg.Integrator,
+		dt:          cfg.Dt,
+		collisions:  cfg.Collisions,
+		restitution: cfg.Restitution,
+		universe:    cfg.Universe,
+		seed:        cfg.Seed,
+		timeScale:   1,
+
+		diagnosticsInterval: cfg.DiagnosticsInterval,
+		driftThreshold:      cfg.DriftThreshold,
+
+		q:    make(chan struct{}),
+		done: make(chan struct{}),
+		c:    make(chan queuedCommand, 20),
 		/*
 			particles:   []*Particle{
 				newParticle(5.972*10e2, vector.V3{}, vector.V3{}),
@@ -365,6 +955,19 @@ func New() *Orrery {
 		*/
 	}
 
+	if o.seed == 0 {
+		o.seed = time.Now().UnixNano()
+		log.Printf(`using random seed %d`, o.seed)
+	}
+	o.reseed()
+
+	if cfg.RewindLength > 0 && cfg.RewindInterval > 0 {
+		o.rewind = newRewindBuffer(cfg.RewindLength)
+		o.rewindInterval = cfg.RewindInterval
+	}
+
+	o.publish()
+
 	go o.loop()
 
 	return o
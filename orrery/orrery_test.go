@@ -0,0 +1,396 @@
+package orrery
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// waitFor polls cond until it is true or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(`timed out`)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStepWhilePaused(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Dt = 0.25
+	o := New(cfg)
+	defer o.Close()
+
+	o.QueueCommand(CommandStep{N: 3})
+	o.QueueCommand(CommandStep{})
+	waitFor(t, func() bool { return o.Ticks() == 4 })
+
+	// No further ticks may happen while paused
+	time.Sleep(20 * time.Millisecond)
+	if n := o.Ticks(); n != 4 {
+		t.Errorf(`expected 4 ticks, got %d`, n)
+	}
+	if tm := o.Time(); tm != 1 {
+		t.Errorf(`expected simulated time 1, got %f`, tm)
+	}
+}
+
+func TestStepWhileRunning(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+
+	// Steps requested while running fail instead of running after the
+	// next pause
+	o.QueueCommand(CommandPause{})
+	if err := o.QueueCommand(CommandStep{N: 1000000}).Wait(); err != ErrNotPaused {
+		t.Errorf(`expected ErrNotPaused, got %v`, err)
+	}
+	o.QueueCommand(CommandPause{}).Wait()
+
+	n := o.Ticks()
+	time.Sleep(20 * time.Millisecond)
+	if m := o.Ticks(); m != n {
+		t.Errorf(`expected no ticks while paused, got %d`, m-n)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orrery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := New(DefaultConfig())
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+
+	record := filepath.Join(dir, "run.csv")
+	err = o.StartRecording(record, 1)
+	if err != nil {
+		t.Fatalf(`can't start recording: %s`, err)
+	}
+
+	// Commands queued before closing are still handled
+	snapshot := filepath.Join(dir, "snapshot.json")
+	o.QueueCommand(CommandPause{})
+	o.QueueCommand(CommandStore{Path: snapshot})
+
+	err = o.Close()
+	if err != nil {
+		t.Fatalf(`can't close: %s`, err)
+	}
+
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Errorf(`queued store wasn't written: %s`, err)
+	}
+	if err := o.StopRecording(); err == nil {
+		t.Errorf(`recording still running after close`)
+	}
+
+	// The loop doesn't tick any further although the orrery is unpaused
+	n := o.Ticks()
+	time.Sleep(20 * time.Millisecond)
+	if o.Ticks() != n {
+		t.Errorf(`ticks advanced after close`)
+	}
+
+	// Closing again and queueing commands doesn't block
+	if err := o.Close(); err != nil {
+		t.Errorf(`second close failed: %s`, err)
+	}
+	o.QueueCommand(CommandPause{})
+}
+
+func TestCommandReply(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+
+	if err := o.QueueCommand(CommandLoad{Path: "does-not-exist.json"}).Wait(); err == nil {
+		t.Errorf(`expected loading a missing file to fail`)
+	}
+
+	// Unknown commands are rejected, and the loop keeps running
+	if err := o.QueueCommand(struct{}{}).Wait(); err == nil {
+		t.Errorf(`expected an unknown command to be rejected`)
+	}
+
+	r := o.QueueCommand(CommandSpawnParticle{})
+	<-r.Done()
+	if err := r.Wait(); err != nil {
+		t.Errorf(`can't spawn particle: %s`, err)
+	}
+	f := o.Frame()
+	if n := len(f.Particles); n != 1 {
+		t.Errorf(`expected 1 particle, got %d`, n)
+	}
+	f.Release()
+
+	o.Close()
+	if err := o.QueueCommand(CommandPause{}).Wait(); err != ErrClosed {
+		t.Errorf(`expected ErrClosed after close, got %v`, err)
+	}
+	if _, err := o.TryQueueCommand(CommandPause{}); err != ErrClosed {
+		t.Errorf(`expected ErrClosed after close, got %v`, err)
+	}
+}
+
+func TestTryQueueCommand(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+
+	// The loop blocks on the lock while handling the first command, so the
+	// queue fills up
+	o.l.Lock()
+	var replies []*Reply
+	var err error
+	for i := 0; i < 2*cap(o.c) && err == nil; i++ {
+		var r *Reply
+		r, err = o.TryQueueCommand(CommandSpawnParticle{})
+		if err == nil {
+			replies = append(replies, r)
+		}
+	}
+	o.l.Unlock()
+
+	if err != ErrQueueFull {
+		t.Fatalf(`expected ErrQueueFull, got %v`, err)
+	}
+
+	for _, r := range replies {
+		if err := r.Wait(); err != nil {
+			t.Errorf(`can't spawn particle: %s`, err)
+		}
+	}
+	f := o.Frame()
+	if n := len(f.Particles); n != len(replies) {
+		t.Errorf(`expected %d particles, got %d`, len(replies), n)
+	}
+	f.Release()
+}
+
+func TestTimeScale(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+
+	o.QueueCommand(CommandSpeedUp{})
+	o.QueueCommand(CommandSpeedUp{})
+	waitFor(t, func() bool { return o.TimeScale() == 4 })
+
+	for i := 0; i < 20; i++ {
+		o.QueueCommand(CommandSlowDown{})
+	}
+	waitFor(t, func() bool { return o.TimeScale() == minTimeScale })
+}
+
+func TestMergeCollision(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Collisions = COLLIDE_MERGE
+	o := New(cfg)
+	defer o.Close()
+
+	a := newParticle(2, vector.V3{}, vector.V3{X: 1})
+	a.T = 1
+	b := newParticle(6, vector.V3{X: 0.1}, vector.V3{Y: -1})
+	b.T = 3
+	c := newParticle(1, vector.V3{X: 0.2}, vector.V3{})
+	far := newParticle(1, vector.V3{X: 1000}, vector.V3{})
+
+	m := a.M + b.M + c.M
+	mom := a.Vel.Scaled(a.M).Add(b.Vel.Scaled(b.M))
+	temp := (a.T*a.M + b.T*b.M) / m
+
+	o.l.Lock()
+	for _, p := range []*Particle{a, b, c, far} {
+		o.addParticle(p)
+	}
+	o.handleCollisions()
+	o.l.Unlock()
+
+	ps := o.Particles()
+	if len(ps) != 2 {
+		t.Fatalf(`expected 2 particles after merging, got %d`, len(ps))
+	}
+
+	p := ps[0]
+	if p.M != m {
+		t.Errorf(`expected mass %f, got %f`, m, p.M)
+	}
+	if d := p.Vel.Scaled(p.M).Distance(mom); d > 1e-9 {
+		t.Errorf(`momentum not conserved: expected %s, got %s`, mom, p.Vel.Scaled(p.M))
+	}
+	if math.Abs(p.T-temp) > 1e-9 {
+		t.Errorf(`expected temperature %f, got %f`, temp, p.T)
+	}
+	if p.ID != b.ID {
+		t.Errorf(`expected the ID %d of the heaviest particle, got %d`, b.ID, p.ID)
+	}
+	if r := math.Pow(m, 1.0/3); p.R != r {
+		t.Errorf(`expected radius %f, got %f`, r, p.R)
+	}
+	if ps[1].ID != far.ID || ps[1].Pos != far.Pos {
+		t.Errorf(`expected far particle to be untouched`)
+	}
+}
+
+// seededRun spawns particles with the orrery's RNG and simulates them,
+// optionally starting from a snapshot. It returns the final state as a
+// binary snapshot.
+func seededRun(t *testing.T, cfg Config, snapshot []byte) []byte {
+	o := New(cfg)
+	defer o.Close()
+
+	if snapshot != nil {
+		err := o.ReadSnapshotBinary(bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatalf(`can't read snapshot: %s`, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		o.handleCommand(CommandSpawnVolume{Pos: vector.V3{X: float64(i) * 50}})
+	}
+	o.Step(100)
+
+	buf := &bytes.Buffer{}
+	err := o.WriteSnapshotBinary(buf)
+	if err != nil {
+		t.Fatalf(`can't write snapshot: %s`, err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeterministic(t *testing.T) {
+	for _, g := range []Gravity{Pairwise{}, BarnesHut{Theta: 0.5}} {
+		cfg := DefaultConfig()
+		cfg.Seed = 1234
+		cfg.Gravity = g
+		cfg.Collisions = COLLIDE_MERGE
+
+		a := seededRun(t, cfg, nil)
+		b := seededRun(t, cfg, nil)
+		if !bytes.Equal(a, b) {
+			t.Errorf(`%s: runs with the same seed diverged`, g)
+		}
+
+		// Continuing from the same snapshot
+		a2 := seededRun(t, cfg, a)
+		b2 := seededRun(t, cfg, b)
+		if !bytes.Equal(a2, b2) {
+			t.Errorf(`%s: runs from the same snapshot diverged`, g)
+		}
+
+		cfg.Seed = 4321
+		c := seededRun(t, cfg, nil)
+		if bytes.Equal(a, c) {
+			t.Errorf(`%s: runs with different seeds are identical`, g)
+		}
+	}
+}
+
+func TestParticleCommands(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	for i := 0; i < 3; i++ {
+		o.addParticle(newParticle(1, vector.V3{X: float64(i) * 10}, vector.V3{}))
+	}
+	o.l.Unlock()
+
+	p, ok := o.Lookup(2)
+	if !ok || p.Pos.X != 10 {
+		t.Fatalf(`expected to find particle 2 at x=10, got %v, %v`, p, ok)
+	}
+	if _, ok := o.Lookup(42); ok {
+		t.Errorf(`found a particle that doesn't exist`)
+	}
+
+	m := 8.0
+	vel := vector.V3{Y: 1}
+	o.handleCommand(CommandEdit{ID: 2, M: &m, Vel: &vel})
+	p, _ = o.Lookup(2)
+	if p.M != 8 || p.R != math.Pow(8, 1.0/3) || p.Vel != vel || p.Pos.X != 10 {
+		t.Errorf(`unexpected particle after editing: %s`, p)
+	}
+
+	// Invalid edits change nothing
+	m = -1
+	pos := vector.V3{X: 100}
+	o.handleCommand(CommandEdit{ID: 2, M: &m, Pos: &pos})
+	p, _ = o.Lookup(2)
+	if p.M != 8 || p.Pos.X != 10 {
+		t.Errorf(`invalid edit changed the particle: %s`, p)
+	}
+
+	o.handleCommand(CommandDelete{ID: 1})
+	o.handleCommand(CommandDelete{ID: 42})
+	ps := o.Particles()
+	if len(ps) != 2 || ps[0].ID != 2 || ps[1].ID != 3 {
+		t.Errorf(`expected particles 2 and 3 after deleting, got %v`, ps)
+	}
+}
+
+func TestSpawnOrbit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Dt = 0.1
+	o := New(cfg)
+	defer o.Close()
+
+	o.handleCommand(CommandSpawnParticle{M: 1000, Vel: vector.V3{X: 0.5}})
+	o.handleCommand(CommandSpawnOrbit{Parent: 1, Pos: vector.V3{Y: 50}, M: 1})
+	o.handleCommand(CommandSpawnOrbit{Parent: 1, Pos: vector.V3{Z: 80}, M: 1, Normal: vector.V3{Y: 1}})
+	o.handleCommand(CommandSpawnOrbit{Parent: 42, Pos: vector.V3{Z: 80}})
+
+	ps := o.Particles()
+	if len(ps) != 3 {
+		t.Fatalf(`expected 3 particles, got %d`, len(ps))
+	}
+	if ps[0].Vel != (vector.V3{X: 0.5}) {
+		t.Errorf(`expected spawn velocity to be kept, got %s`, ps[0].Vel)
+	}
+
+	// Roughly two orbits of the inner particle
+	for i := 0; i < 20; i++ {
+		o.Step(100)
+
+		ps := o.Particles()
+		for _, p := range ps[1:] {
+			r0 := 50.0
+			if p.ID == 3 {
+				r0 = 80
+			}
+			if d := p.Pos.Distance(ps[0].Pos); math.Abs(d-r0)/r0 > 0.02 {
+				t.Fatalf(`tick %d: particle %d strayed to distance %f from %f`, o.Ticks(), p.ID, d, r0)
+			}
+		}
+	}
+}
+
+func TestSpawnOrbitWithoutGravity(t *testing.T) {
+	for _, g := range []float64{0, -1} {
+		cfg := DefaultConfig()
+		cfg.G = g
+		o := New(cfg)
+
+		o.handleCommand(CommandSpawnParticle{M: 1000})
+		if err := o.handleCommand(CommandSpawnOrbit{Parent: 1, Pos: vector.V3{Y: 50}}); err == nil {
+			t.Errorf(`G %f: expected spawning an orbit to fail`, g)
+		}
+		if err := o.Generate(Plummer{N: 10, Mass: 10, Radius: 10}, 1, vector.V3{}, vector.V3{}); err == nil {
+			t.Errorf(`G %f: expected generating to fail`, g)
+		}
+		if n := len(o.Particles()); n != 1 {
+			t.Errorf(`G %f: expected only the parent, got %d particles`, g, n)
+		}
+		o.Close()
+	}
+}
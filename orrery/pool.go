@@ -0,0 +1,88 @@
+package orrery
+
+import (
+	"runtime"
+	"sync"
+)
+
+// workerPool runs work on a fixed set of goroutines, so that none have to be
+// started every tick. Work is split by index ranges. Solvers must compute
+// every item the same way no matter which worker handles it, so that the
+// results don't depend on the number of workers. run may be called from
+// several goroutines at once, also after close.
+type workerPool struct {
+	n    int
+	jobs chan poolJob
+
+	l      sync.RWMutex // held for reading while jobs are handed out
+	closed bool         // guarded by l
+}
+
+type poolJob struct {
+	f  func(w int)
+	w  int
+	wg *sync.WaitGroup
+}
+
+// newWorkerPool starts n workers, or GOMAXPROCS of them if n is below 1.
+func newWorkerPool(n int) *workerPool {
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	p := &workerPool{
+		n:    n,
+		jobs: make(chan poolJob, n),
+	}
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *workerPool) work() {
+	for j := range p.jobs {
+		j.f(j.w)
+		j.wg.Done()
+	}
+}
+
+// run calls f once with every worker index and waits until all calls have
+// returned. Once the pool is closed, the calls are made one after another
+// on the calling goroutine instead.
+func (p *workerPool) run(f func(w int)) {
+	p.l.RLock()
+	if p.closed {
+		p.l.RUnlock()
+		for w := 0; w < p.n; w++ {
+			f(w)
+		}
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(p.n)
+	for w := 0; w < p.n; w++ {
+		p.jobs <- poolJob{f: f, w: w, wg: &wg}
+	}
+	p.l.RUnlock()
+
+	wg.Wait()
+}
+
+// close stops the workers once they are done with the work they have.
+func (p *workerPool) close() {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+}
+
+// span returns the range [lo, hi) of n items that worker w handles.
+func (p *workerPool) span(n, w int) (lo, hi int) {
+	return n * w / p.n, n * (w + 1) / p.n
+}
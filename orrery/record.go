@@ -0,0 +1,188 @@
+package orrery
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// TrajectorySample is the state of a single particle at a recorded tick, as
+// written to NDJSON trajectory files.
+type TrajectorySample struct {
+	Tick uint64
+	Time float64
+	ID   uint64
+	M    float64
+	R    float64
+	Pos  vector.V3
+	Vel  vector.V3
+}
+
+// trajectoryHeader holds the columns of CSV trajectory files.
+var trajectoryHeader = []string{"tick", "time", "id", "m", "r", "x", "y", "z", "vx", "vy", "vz"}
+
+// recorder streams the state of all particles to a file every interval
+// ticks.
+type recorder struct {
+	fh       io.WriteCloser
+	w        *bufio.Writer
+	csv      *csv.Writer   // set for CSV files
+	json     *json.Encoder // set for NDJSON files
+	interval uint64
+}
+
+func newRecorder(fname string, interval int) (*recorder, error) {
+	if interval < 1 {
+		return nil, fmt.Errorf(`recording interval must be positive, got %d`, interval)
+	}
+
+	r := &recorder{interval: uint64(interval)}
+
+	switch filepath.Ext(fname) {
+	case ".csv":
+	case ".ndjson", ".jsonl":
+	default:
+		return nil, fmt.Errorf(`unknown trajectory format %q, use .csv or .ndjson`, filepath.Ext(fname))
+	}
+
+	fh, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	r.fh = fh
+	r.w = bufio.NewWriter(fh)
+
+	if filepath.Ext(fname) == ".csv" {
+		r.csv = csv.NewWriter(r.w)
+		err = r.csv.Write(trajectoryHeader)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+	} else {
+		r.json = json.NewEncoder(r.w)
+	}
+
+	return r, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (r *recorder) record(tick uint64, time float64, ps *particleStore) error {
+	for i, id := range ps.id {
+		s := TrajectorySample{
+			Tick: tick,
+			Time: time,
+			ID:   id,
+			M:    ps.m[i],
+			R:    ps.r[i],
+			Pos:  ps.pos[i],
+			Vel:  ps.vel[i],
+		}
+
+		var err error
+		if r.csv != nil {
+			err = r.csv.Write([]string{
+				strconv.FormatUint(s.Tick, 10),
+				formatFloat(s.Time),
+				strconv.FormatUint(s.ID, 10),
+				formatFloat(s.M),
+				formatFloat(s.R),
+				formatFloat(s.Pos.X), formatFloat(s.Pos.Y), formatFloat(s.Pos.Z),
+				formatFloat(s.Vel.X), formatFloat(s.Vel.Y), formatFloat(s.Vel.Z),
+			})
+		} else {
+			err = r.json.Encode(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *recorder) close() error {
+	if r.csv != nil {
+		r.csv.Flush()
+		if err := r.csv.Error(); err != nil {
+			r.fh.Close()
+			return err
+		}
+	}
+
+	err := r.w.Flush()
+	if err != nil {
+		r.fh.Close()
+		return err
+	}
+
+	return r.fh.Close()
+}
+
+// recordTrajectories writes the current state to the trajectory file. On
+// errors, recording stops. The caller must hold o.l.
+func (o *Orrery) recordTrajectories() {
+	o.assignIDs()
+
+	err := o.recorder.record(o.ticks, o.time, o.particles)
+	if err == nil {
+		return
+	}
+
+	log.Printf(`can't record trajectories, stopping: %s`, err)
+	o.recorder.close()
+	o.recorder = nil
+}
+
+// StartRecording writes the position, velocity and mass of every particle
+// to the file fname every interval ticks, starting with the current state.
+// The extension of fname selects the format, .csv or .ndjson. A recording
+// that is already running is stopped first. Recording goes on after
+// rewinding or loading a snapshot, so the ticks in the file go back where
+// that happened, and the ticks after it appear more than once.
+func (o *Orrery) StartRecording(fname string, interval int) error {
+	r, err := newRecorder(fname, interval)
+	if err != nil {
+		return err
+	}
+
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.recorder != nil {
+		err = o.recorder.close()
+		if err != nil {
+			log.Printf(`can't close previous recording: %s`, err)
+		}
+	}
+	o.recorder = r
+	o.recordTrajectories()
+
+	return nil
+}
+
+// StopRecording flushes and closes the trajectory file.
+func (o *Orrery) StopRecording() error {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.recorder == nil {
+		return errors.New(`not recording`)
+	}
+
+	err := o.recorder.close()
+	o.recorder = nil
+	return err
+}
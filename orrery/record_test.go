@@ -0,0 +1,116 @@
+package orrery
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func recordTwoBody(t *testing.T, fname string) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+
+	err := o.StartRecording(fname, 5)
+	if err != nil {
+		t.Fatalf(`can't start recording: %s`, err)
+	}
+
+	o.Step(20)
+
+	err = o.StopRecording()
+	if err != nil {
+		t.Fatalf(`can't stop recording: %s`, err)
+	}
+}
+
+func TestRecordCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orrery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "run.csv")
+	recordTwoBody(t, fname)
+
+	fh, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	rows, err := csv.NewReader(fh).ReadAll()
+	if err != nil {
+		t.Fatalf(`can't parse recording: %s`, err)
+	}
+
+	// Header, then two particles at ticks 0, 5, 10, 15 and 20
+	if len(rows) != 1+2*5 {
+		t.Fatalf(`expected 11 rows, got %d`, len(rows))
+	}
+	if rows[0][0] != "tick" || len(rows[0]) != len(trajectoryHeader) {
+		t.Errorf(`unexpected header %v`, rows[0])
+	}
+	if rows[1][0] != "0" || rows[10][0] != "20" {
+		t.Errorf(`unexpected ticks %s and %s`, rows[1][0], rows[10][0])
+	}
+	if rows[1][2] != "1" || rows[2][2] != "2" {
+		t.Errorf(`expected particle IDs 1 and 2, got %s and %s`, rows[1][2], rows[2][2])
+	}
+}
+
+func TestRecordNDJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orrery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "run.ndjson")
+	recordTwoBody(t, fname)
+
+	fh, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	samples := []TrajectorySample{}
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		s := TrajectorySample{}
+		err := json.Unmarshal(sc.Bytes(), &s)
+		if err != nil {
+			t.Fatalf(`can't parse line %q: %s`, sc.Text(), err)
+		}
+		samples = append(samples, s)
+	}
+
+	if len(samples) != 2*5 {
+		t.Fatalf(`expected 10 samples, got %d`, len(samples))
+	}
+	last := samples[len(samples)-1]
+	if last.Tick != 20 || last.ID != 2 || last.M != 1 {
+		t.Errorf(`unexpected last sample %+v`, last)
+	}
+}
+
+func TestRecordUnknownFormat(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.StartRecording("run.txt", 1)
+	if err == nil {
+		t.Errorf(`expected an error for an unknown format`)
+	}
+	if _, err := os.Stat("run.txt"); err == nil {
+		t.Errorf(`file was created for an unknown format`)
+		os.Remove("run.txt")
+	}
+}
@@ -0,0 +1,210 @@
+package orrery
+
+import (
+	"math/rand"
+	"sort"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// rewindParticle is the part of a particle's state that is kept in the
+// rewind buffer. Trails are left out to keep frames small.
+type rewindParticle struct {
+	ID  uint64
+	T   float64
+	R   float64
+	M   float64
+	Pos vector.V3
+	Vel vector.V3
+}
+
+// rewindFrame is the state of the orrery at a single tick.
+type rewindFrame struct {
+	tick      uint64
+	time      float64
+	particles []rewindParticle
+}
+
+// rewindBuffer is a ring buffer of frames, ordered by tick. When it is full,
+// the oldest frame is overwritten.
+type rewindBuffer struct {
+	frames []rewindFrame
+	start  int // index of the oldest frame
+	n      int // number of frames in the buffer
+}
+
+func newRewindBuffer(length int) *rewindBuffer {
+	return &rewindBuffer{frames: make([]rewindFrame, length)}
+}
+
+// at returns the i-th oldest frame.
+func (b *rewindBuffer) at(i int) *rewindFrame {
+	return &b.frames[(b.start+i)%len(b.frames)]
+}
+
+// next adds a frame after the newest one and returns it, overwriting the
+// oldest frame if the buffer is full. The returned frame still holds the
+// particles of the frame it replaces, so that their slice can be reused.
+func (b *rewindBuffer) next() *rewindFrame {
+	if b.n < len(b.frames) {
+		b.n++
+		return b.at(b.n - 1)
+	}
+
+	f := &b.frames[b.start]
+	b.start = (b.start + 1) % len(b.frames)
+	return f
+}
+
+func (b *rewindBuffer) reset() {
+	b.start, b.n = 0, 0
+}
+
+// truncate drops all frames after tick.
+func (b *rewindBuffer) truncate(tick uint64) {
+	b.n = sort.Search(b.n, func(i int) bool {
+		return b.at(i).tick > tick
+	})
+}
+
+// seek returns the index of the frame that is n frames before tick, or
+// after it for negative n. Frames at tick itself don't count as a step. The
+// result is clamped to the frames in the buffer, ok is false if there is no
+// frame in that direction at all.
+func (b *rewindBuffer) seek(tick uint64, n int) (i int, ok bool) {
+	if n > 0 {
+		// Index of the last frame before tick
+		i = sort.Search(b.n, func(i int) bool {
+			return b.at(i).tick >= tick
+		}) - 1
+		if i < 0 {
+			return 0, false
+		}
+		i -= n - 1
+	} else {
+		// Index of the first frame after tick
+		i = sort.Search(b.n, func(i int) bool {
+			return b.at(i).tick > tick
+		})
+		if i >= b.n {
+			return 0, false
+		}
+		i += -n - 1
+	}
+
+	if i < 0 {
+		i = 0
+	}
+	if i >= b.n {
+		i = b.n - 1
+	}
+	return i, true
+}
+
+// recordFrame adds the current state to the rewind buffer. The caller must
+// hold o.l.
+func (o *Orrery) recordFrame() {
+	o.assignIDs()
+
+	s := o.particles
+	f := o.rewind.next()
+	f.tick = o.ticks
+	f.time = o.time
+	f.particles = f.particles[:0]
+	for i, id := range s.id {
+		f.particles = append(f.particles, rewindParticle{
+			ID:  id,
+			T:   s.t[i],
+			R:   s.r[i],
+			M:   s.m[i],
+			Pos: s.pos[i],
+			Vel: s.vel[i],
+		})
+	}
+}
+
+// restoreFrame replaces the state of the orrery with f. Diagnostics
+// recorded after f are dropped, and drift is measured against a new
+// reference. The caller must hold o.l.
+func (o *Orrery) restoreFrame(f *rewindFrame) {
+	o.particles = &particleStore{}
+	for _, rp := range f.particles {
+		o.particles.add(&Particle{
+			ID:  rp.ID,
+			T:   rp.T,
+			R:   rp.R,
+			M:   rp.M,
+			Pos: rp.Pos,
+			Vel: rp.Vel,
+		})
+	}
+	o.setClock(f.time, f.tick)
+	o.reseed()
+	o.reference = nil
+	o.drifting = false
+
+	k := sort.Search(len(o.history), func(i int) bool {
+		return o.history[i].Tick > f.tick
+	})
+	o.history = o.history[:k]
+}
+
+// rewindBy moves the simulation n frames back in the rewind buffer, or
+// forward for negative n. Moving forward is only possible until the
+// simulation continues from an earlier frame, which discards the frames
+// after it. The caller must hold o.l.
+func (o *Orrery) rewindBy(n int) {
+	if o.rewind == nil || n == 0 {
+		return
+	}
+
+	i, ok := o.rewind.seek(o.ticks, n)
+	if ok {
+		o.restoreFrame(o.rewind.at(i))
+	}
+}
+
+// RewindRange returns the first and last tick that can be rewound to. ok is
+// false if the rewind buffer is empty or disabled.
+func (o *Orrery) RewindRange() (first, last uint64, ok bool) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	return o.rewindRange()
+}
+
+// rewindRange is RewindRange for callers that hold o.l.
+func (o *Orrery) rewindRange() (first, last uint64, ok bool) {
+	if o.rewind == nil || o.rewind.n == 0 {
+		return 0, 0, false
+	}
+
+	return o.rewind.at(0).tick, o.rewind.at(o.rewind.n - 1).tick, true
+}
+
+// Fork returns a new, paused orrery with the same configuration that starts
+// from the current state of o, including the state of its random number
+// generator, so that both continue identically. The rewind buffer and
+// diagnostics are not copied.
+func (o *Orrery) Fork() *Orrery {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	cfg := o.cfg
+	cfg.Seed = o.seed
+	n := New(cfg)
+
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	n.particles = o.particles.copy()
+	n.nextID = o.nextID
+	n.time, n.ticks = o.time, o.ticks
+	n.epoch, n.epochTick = o.epoch, o.epochTick
+	n.timeScale = o.timeScale
+	n.rand = o.rand.clone()
+	n.rng = rand.New(n.rand)
+	n.publish()
+
+	return n
+}
@@ -0,0 +1,201 @@
+package orrery
+
+import (
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestRewindBuffer(t *testing.T) {
+	b := newRewindBuffer(10)
+	for i := uint64(1); i <= 15; i++ {
+		b.next().tick = i * 10
+	}
+
+	if b.n != 10 || b.at(0).tick != 60 || b.at(9).tick != 150 {
+		t.Fatalf(`expected ticks 60 to 150, got %d frames from %d to %d`, b.n, b.at(0).tick, b.at(b.n-1).tick)
+	}
+
+	for _, tc := range []struct {
+		tick uint64
+		n    int
+		want uint64
+		ok   bool
+	}{
+		{150, 1, 140, true},
+		{155, 1, 150, true},
+		{150, 3, 120, true},
+		{150, 100, 60, true},
+		{60, 1, 0, false},
+		{100, -1, 110, true},
+		{105, -1, 110, true},
+		{100, -100, 150, true},
+		{150, -1, 0, false},
+	} {
+		i, ok := b.seek(tc.tick, tc.n)
+		if ok != tc.ok || (ok && b.at(i).tick != tc.want) {
+			t.Errorf(`seek(%d, %d): expected %d (%v), got %d (%v)`, tc.tick, tc.n, tc.want, tc.ok, b.at(i).tick, ok)
+		}
+	}
+
+	b.truncate(100)
+	if b.n != 5 || b.at(b.n-1).tick != 100 {
+		t.Errorf(`expected 5 frames up to tick 100, got %d up to %d`, b.n, b.at(b.n-1).tick)
+	}
+}
+
+func rewindOrrery() *Orrery {
+	cfg := DefaultConfig()
+	cfg.RewindLength = 10
+	cfg.RewindInterval = 5
+	o := New(cfg)
+
+	o.l.Lock()
+	for _, p := range twoBody() {
+		o.addParticle(p)
+	}
+	o.l.Unlock()
+
+	return o
+}
+
+func samePositions(t *testing.T, ps, expected []*Particle) {
+	if len(ps) != len(expected) {
+		t.Fatalf(`expected %d particles, got %d`, len(expected), len(ps))
+	}
+	for i := range ps {
+		if ps[i].ID != expected[i].ID || ps[i].Pos != expected[i].Pos || ps[i].Vel != expected[i].Vel {
+			t.Errorf(`particle %d: expected %s, got %s`, i, expected[i], ps[i])
+		}
+	}
+}
+
+func TestRewind(t *testing.T) {
+	o := rewindOrrery()
+	defer o.Close()
+	o.Step(20)
+	at20 := o.Particles()
+
+	ref := rewindOrrery()
+	defer ref.Close()
+	ref.Step(10)
+
+	o.l.Lock()
+	o.rewindBy(2)
+	o.l.Unlock()
+
+	if o.Ticks() != 10 || o.Time() != 10 {
+		t.Fatalf(`expected to be back at tick 10, got %d`, o.Ticks())
+	}
+	samePositions(t, o.Particles(), ref.Particles())
+
+	// Frames after the current one are kept until the simulation continues
+	if first, last, _ := o.RewindRange(); first != 5 || last != 20 {
+		t.Errorf(`expected rewind range 5 to 20, got %d to %d`, first, last)
+	}
+
+	o.l.Lock()
+	o.rewindBy(-2)
+	o.l.Unlock()
+	if o.Ticks() != 20 {
+		t.Fatalf(`expected to be forward at tick 20, got %d`, o.Ticks())
+	}
+	samePositions(t, o.Particles(), at20)
+
+	// Continuing from an earlier frame forks the run
+	o.l.Lock()
+	o.rewindBy(2)
+	o.l.Unlock()
+	o.Step(2)
+	if first, last, _ := o.RewindRange(); first != 5 || last != 10 {
+		t.Errorf(`expected rewind range 5 to 10 after forking, got %d to %d`, first, last)
+	}
+	o.Step(8)
+	samePositions(t, o.Particles(), at20)
+}
+
+func TestRewindDiagnosticsReference(t *testing.T) {
+	o := rewindOrrery()
+	defer o.Close()
+	o.diagnosticsInterval = 5
+	o.Step(10)
+
+	// The edit changes the energy, but not the number of particles
+	m := 5.0
+	if err := o.handleCommand(CommandEdit{ID: 1, M: &m}); err != nil {
+		t.Fatal(err)
+	}
+	o.Step(10)
+
+	if err := o.handleCommand(CommandRewind{N: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if o.Ticks() != 5 {
+		t.Fatalf(`expected to be back at tick 5, got %d`, o.Ticks())
+	}
+	o.Step(5)
+	if last, _ := o.LastDiagnostics(); last.Tick != 10 || last.EnergyDrift != 0 {
+		t.Errorf(`expected a new reference at tick 10 after rewinding, got energy drift %g at tick %d`, last.EnergyDrift, last.Tick)
+	}
+}
+
+func TestFork(t *testing.T) {
+	o := rewindOrrery()
+	defer o.Close()
+	o.Step(10)
+
+	f := o.Fork()
+	defer f.Close()
+	samePositions(t, f.Particles(), o.Particles())
+	if f.Ticks() != 10 {
+		t.Errorf(`expected fork at tick 10, got %d`, f.Ticks())
+	}
+
+	f.Step(5)
+	if o.Ticks() != 10 {
+		t.Errorf(`stepping the fork advanced the original to tick %d`, o.Ticks())
+	}
+
+	o.l.Lock()
+	f.l.Lock()
+	o.particles.pos[0] = vector.V3{}
+	if f.particles.pos[0] == (vector.V3{}) {
+		t.Errorf(`fork shares particles with the original`)
+	}
+	f.l.Unlock()
+	o.l.Unlock()
+}
+
+func TestForkRandom(t *testing.T) {
+	o := rewindOrrery()
+	defer o.Close()
+	o.QueueCommand(CommandSpawnVolume{}).Wait()
+	o.Step(10)
+
+	// Random events after the fork are the same in both
+	f := o.Fork()
+	defer f.Close()
+	o.QueueCommand(CommandSpawnVolume{}).Wait()
+	f.QueueCommand(CommandSpawnVolume{}).Wait()
+	samePositions(t, f.Particles(), o.Particles())
+}
+
+func TestRewindBufferReuse(t *testing.T) {
+	o := rewindOrrery()
+	defer o.Close()
+	o.Step(50)
+
+	o.l.Lock()
+	oldest := &o.rewind.at(0).particles[0]
+	o.l.Unlock()
+
+	// The next frame overwrites the oldest one and keeps its particles
+	o.Step(5)
+
+	o.l.Lock()
+	defer o.l.Unlock()
+	f := o.rewind.at(o.rewind.n - 1)
+	if f.tick != 55 || &f.particles[0] != oldest {
+		t.Errorf(`expected frame at tick 55 to reuse the particles of the oldest frame, got tick %d`, f.tick)
+	}
+}
@@ -0,0 +1,405 @@
+package orrery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// Version of the snapshot format written by WriteSnapshot. Older versions
+// are migrated to this one when they are read.
+//
+// Version 1 is a bare JSON array of particles.
+// Version 2 adds the header with the version and the simulation parameters.
+// Version 3 adds particle IDs and the last ID handed out.
+const snapshotVersion = 3
+
+// SnapshotMeta holds the simulation parameters a snapshot was taken with.
+type SnapshotMeta struct {
+	G          float64
+	Gravity    string
+	Integrator string
+	Dt         float64
+	Time       float64 // simulated time
+	Ticks      uint64
+	Seed       int64
+	NextID     uint64 // last particle ID handed out
+}
+
+type snapshot struct {
+	Version   int
+	Meta      SnapshotMeta
+	Particles []*Particle
+}
+
+// migrations convert a snapshot of version n into one of version n+1.
+var migrations = map[int]func([]byte) ([]byte, error){
+	1: func(data []byte) ([]byte, error) {
+		s := struct {
+			Version   int
+			Particles json.RawMessage
+		}{2, data}
+		return json.Marshal(s)
+	},
+	// Particles without an ID get a new one when they are loaded
+	2: func(data []byte) ([]byte, error) {
+		s := map[string]json.RawMessage{}
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return nil, err
+		}
+		s["Version"] = json.RawMessage(`3`)
+		return json.Marshal(s)
+	},
+}
+
+// snapshotVersionOf returns the format version of the encoded snapshot.
+func snapshotVersionOf(data []byte) (int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return 1, nil
+	}
+
+	v := struct{ Version int }{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return 0, err
+	}
+	if v.Version == 0 {
+		return 0, errors.New(`snapshot has no version`)
+	}
+
+	return v.Version, nil
+}
+
+func migrateSnapshot(data []byte) ([]byte, error) {
+	v, err := snapshotVersionOf(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if v > snapshotVersion {
+		return nil, fmt.Errorf(`snapshot version %d is newer than the supported version %d`, v, snapshotVersion)
+	}
+
+	for ; v < snapshotVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return nil, fmt.Errorf(`can't migrate snapshot version %d`, v)
+		}
+		data, err = m(data)
+		if err != nil {
+			return nil, fmt.Errorf(`can't migrate snapshot version %d: %s`, v, err)
+		}
+	}
+
+	return data, nil
+}
+
+func weird(fs ...float64) bool {
+	for _, f := range fs {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func weirdV3(v vector.V3) bool {
+	return weird(v.X, v.Y, v.Z)
+}
+
+func (p *Particle) validate() error {
+	if weird(p.T, p.R, p.M) || weirdV3(p.Pos) || weirdV3(p.Vel) {
+		return errors.New(`NaN or infinite value`)
+	}
+	for _, t := range p.Trail {
+		if weirdV3(t) {
+			return errors.New(`NaN or infinite value in trail`)
+		}
+	}
+	if p.M <= 0 {
+		return fmt.Errorf(`mass %f is not positive`, p.M)
+	}
+	if p.R <= 0 {
+		return fmt.Errorf(`radius %f is not positive`, p.R)
+	}
+	return nil
+}
+
+func (s *snapshot) validate() error {
+	if weird(s.Meta.G, s.Meta.Dt, s.Meta.Time) {
+		return errors.New(`NaN or infinite simulation parameter`)
+	}
+
+	ids := make(map[uint64]bool)
+	for i, p := range s.Particles {
+		if p == nil {
+			return fmt.Errorf(`particle %d is missing`, i)
+		}
+		if p.ID != 0 && ids[p.ID] {
+			return fmt.Errorf(`particle %d: duplicate ID %d`, i, p.ID)
+		}
+		ids[p.ID] = true
+		err := p.validate()
+		if err != nil {
+			return fmt.Errorf(`particle %d: %s`, i, err)
+		}
+	}
+
+	return nil
+}
+
+// ReadSnapshot replaces the particles of the orrery with those read from r.
+// Snapshots in older formats are migrated, and the particles are checked
+// for invalid values before anything is replaced. The simulation clock is
+// restored from the snapshot.
+func (o *Orrery) ReadSnapshot(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	data, err = migrateSnapshot(data)
+	if err != nil {
+		return err
+	}
+
+	s := snapshot{}
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	err = s.validate()
+	if err != nil {
+		return fmt.Errorf(`invalid snapshot: %s`, err)
+	}
+
+	o.restore(s)
+	return nil
+}
+
+// restore replaces the state of the orrery with the validated snapshot s.
+func (o *Orrery) restore(s snapshot) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	meta := o.snapshotMeta()
+	if s.Meta.G != 0 && s.Meta.G != meta.G {
+		log.Printf(`snapshot was taken with G=%f, simulating with G=%f`, s.Meta.G, meta.G)
+	}
+	if s.Meta.Integrator != "" && s.Meta.Integrator != meta.Integrator {
+		log.Printf(`snapshot was taken with the %s integrator, simulating with %s`, s.Meta.Integrator, meta.Integrator)
+	}
+
+	if s.Meta.Seed != 0 && s.Meta.Seed != meta.Seed {
+		log.Printf(`continuing with seed %d of the snapshot instead of %d`, s.Meta.Seed, meta.Seed)
+		o.seed = s.Meta.Seed
+	}
+
+	o.particles = newParticleStore(s.Particles)
+	o.nextID = s.Meta.NextID
+	o.assignIDs()
+	o.setClock(s.Meta.Time, s.Meta.Ticks)
+	o.reseed()
+
+	// Diagnostics of the previous universe don't apply to this one
+	o.history = nil
+	o.reference = nil
+	o.drifting = false
+	if o.rewind != nil {
+		o.rewind.reset()
+	}
+	o.dirty = true
+}
+
+// snapshotMeta returns the metadata for a snapshot of the current state.
+// The caller must hold o.l.
+func (o *Orrery) snapshotMeta() SnapshotMeta {
+	return SnapshotMeta{
+		G:          o.kernel.G,
+		Gravity:    o.gravity.String(),
+		Integrator: o.integrator.String(),
+		Dt:         o.dt,
+		Time:       o.time,
+		Ticks:      o.ticks,
+		Seed:       o.seed,
+		NextID:     o.nextID,
+	}
+}
+
+// takeSnapshot copies the current state of the orrery, so that it can be
+// encoded without holding o.l. Trails are shared with the live particles,
+// see particleStore.updateTrails.
+func (o *Orrery) takeSnapshot() snapshot {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	o.assignIDs()
+
+	ps := o.particles
+	s := snapshot{
+		Version:   snapshotVersion,
+		Meta:      o.snapshotMeta(),
+		Particles: make([]*Particle, ps.len()),
+	}
+	for i, id := range ps.id {
+		s.Particles[i] = &Particle{
+			ID:    id,
+			T:     ps.t[i],
+			R:     ps.r[i],
+			M:     ps.m[i],
+			Pos:   ps.pos[i],
+			Vel:   ps.vel[i],
+			Trail: ps.trail[i],
+		}
+	}
+
+	return s
+}
+
+// WriteSnapshot writes the particles of the orrery and the simulation
+// parameters to w as JSON.
+func (o *Orrery) WriteSnapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(o.takeSnapshot())
+}
+
+// snapshotFormat describes how a snapshot file is encoded, derived from
+// its name. A trailing .gz means the file is gzip compressed, .bin before
+// that selects the binary format. Everything else is JSON.
+type snapshotFormat struct {
+	binary bool
+	gzip   bool
+}
+
+func snapshotFormatOf(fname string) snapshotFormat {
+	f := snapshotFormat{}
+	if strings.HasSuffix(fname, ".gz") {
+		f.gzip = true
+		fname = strings.TrimSuffix(fname, ".gz")
+	}
+	f.binary = filepath.Ext(fname) == ".bin"
+	return f
+}
+
+// LoadSnapshot reads a snapshot from the file fname, in the format given by
+// its extension.
+func (o *Orrery) LoadSnapshot(fname string) error {
+	f := snapshotFormatOf(fname)
+
+	fh, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	var r io.Reader = fh
+	if f.gzip {
+		gz, err := gzip.NewReader(fh)
+		if err != nil {
+			return fmt.Errorf(`can't load %s: %s`, fname, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if f.binary {
+		err = o.ReadSnapshotBinary(r)
+	} else {
+		err = o.ReadSnapshot(r)
+	}
+	if err != nil {
+		return fmt.Errorf(`can't load %s: %s`, fname, err)
+	}
+
+	return nil
+}
+
+// SaveSnapshot writes a snapshot to the file fname, in the format given by
+// its extension. The snapshot is written to a temporary file next to fname
+// first, which then replaces fname, so a failed save leaves an existing
+// file alone.
+func (o *Orrery) SaveSnapshot(fname string) error {
+	f := snapshotFormatOf(fname)
+
+	fh, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname)+".")
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+	defer os.Remove(tmp) // fails once the file has been renamed
+
+	w := io.Writer(fh)
+	var gz *gzip.Writer
+	if f.gzip {
+		gz = gzip.NewWriter(fh)
+		w = gz
+	}
+
+	if f.binary {
+		err = o.WriteSnapshotBinary(w)
+	} else {
+		err = o.WriteSnapshot(w)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		// TempFile only grants access to the owner
+		err = fh.Chmod(0644)
+	}
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err != nil {
+		fh.Close()
+		return fmt.Errorf(`can't write snapshot to %s: %s`, fname, err)
+	}
+
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fname)
+}
+
+func (o *Orrery) loadUniverse(fname string) error {
+	if fname == "" {
+		fname = o.universe
+	}
+
+	err := o.LoadSnapshot(fname)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(`loaded universe from %s`, fname)
+	return nil
+}
+
+func (o *Orrery) storeUniverse(fname string) error {
+	if fname == "" {
+		fname = o.universe
+	}
+
+	err := o.SaveSnapshot(fname)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(`dumped universe to %s`, fname)
+	return nil
+}
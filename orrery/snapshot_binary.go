@@ -0,0 +1,333 @@
+package orrery
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// Binary snapshots are little-endian and laid out as
+//
+//	magic "ORRB", uint32 version
+//	G, Dt, Time float64, Ticks uint64, Seed int64, NextID uint64
+//	Gravity, Integrator as uint32 length followed by the bytes
+//	uint64 number of particles
+//	per particle: ID uint64, T, R, M float64, Pos, Vel as three float64
+//	    each, uint32 trail length, the trail points as three float64 each
+//
+// The version is the same as that of the JSON format. There are no binary
+// snapshots older than version 2, which lacks NextID and the particle IDs.
+var binaryMagic = [4]byte{'O', 'R', 'R', 'B'}
+
+const (
+	binaryMaxString = 1 << 10
+	binaryMaxTrail  = 1 << 16
+)
+
+// SnapshotEncoder writes a binary snapshot one particle at a time.
+type SnapshotEncoder struct {
+	w       *bufio.Writer
+	buf     [8]byte
+	n       uint64 // number of particles announced in the header
+	written uint64
+	err     error
+}
+
+// NewSnapshotEncoder writes the header of a binary snapshot with n particles
+// to w. Exactly n particles have to be passed to Encode before Close.
+func NewSnapshotEncoder(w io.Writer, meta SnapshotMeta, n int) (*SnapshotEncoder, error) {
+	e := &SnapshotEncoder{
+		w: bufio.NewWriter(w),
+		n: uint64(n),
+	}
+
+	e.bytes(binaryMagic[:])
+	e.uint32(snapshotVersion)
+	e.float64(meta.G, meta.Dt, meta.Time)
+	e.uint64(meta.Ticks)
+	e.uint64(uint64(meta.Seed))
+	e.uint64(meta.NextID)
+	e.string(meta.Gravity)
+	e.string(meta.Integrator)
+	e.uint64(e.n)
+
+	return e, e.err
+}
+
+func (e *SnapshotEncoder) bytes(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *SnapshotEncoder) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(e.buf[:4], v)
+	e.bytes(e.buf[:4])
+}
+
+func (e *SnapshotEncoder) uint64(v uint64) {
+	binary.LittleEndian.PutUint64(e.buf[:], v)
+	e.bytes(e.buf[:])
+}
+
+func (e *SnapshotEncoder) float64(fs ...float64) {
+	for _, f := range fs {
+		e.uint64(math.Float64bits(f))
+	}
+}
+
+func (e *SnapshotEncoder) v3(v vector.V3) {
+	e.float64(v.X, v.Y, v.Z)
+}
+
+func (e *SnapshotEncoder) string(s string) {
+	if len(s) > binaryMaxString && e.err == nil {
+		e.err = fmt.Errorf(`string of length %d is too long`, len(s))
+	}
+	e.uint32(uint32(len(s)))
+	e.bytes([]byte(s))
+}
+
+// Encode writes a single particle.
+func (e *SnapshotEncoder) Encode(p *Particle) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.written == e.n {
+		return fmt.Errorf(`more than the announced %d particles`, e.n)
+	}
+	if len(p.Trail) > binaryMaxTrail {
+		return fmt.Errorf(`trail of length %d is too long`, len(p.Trail))
+	}
+
+	e.uint64(p.ID)
+	e.float64(p.T, p.R, p.M)
+	e.v3(p.Pos)
+	e.v3(p.Vel)
+	e.uint32(uint32(len(p.Trail)))
+	for _, t := range p.Trail {
+		e.v3(t)
+	}
+	e.written++
+
+	return e.err
+}
+
+// Close flushes the snapshot to the underlying writer. It does not close
+// the writer.
+func (e *SnapshotEncoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.written != e.n {
+		return fmt.Errorf(`announced %d particles, but got %d`, e.n, e.written)
+	}
+	return e.w.Flush()
+}
+
+// SnapshotDecoder reads a binary snapshot one particle at a time.
+type SnapshotDecoder struct {
+	r       *bufio.Reader
+	buf     [8]byte
+	version uint32
+	meta    SnapshotMeta
+	n       uint64
+	read    uint64
+	err     error
+}
+
+// NewSnapshotDecoder reads the header of a binary snapshot from r.
+func NewSnapshotDecoder(r io.Reader) (*SnapshotDecoder, error) {
+	d := &SnapshotDecoder{
+		r: bufio.NewReader(r),
+	}
+
+	magic := [4]byte{}
+	d.bytes(magic[:])
+	if d.err == nil && magic != binaryMagic {
+		return nil, errors.New(`not a binary snapshot`)
+	}
+
+	d.version = d.uint32()
+	if d.err == nil && (d.version < 2 || d.version > snapshotVersion) {
+		return nil, fmt.Errorf(`unsupported binary snapshot version %d`, d.version)
+	}
+
+	d.meta.G = d.float64()
+	d.meta.Dt = d.float64()
+	d.meta.Time = d.float64()
+	d.meta.Ticks = d.uint64()
+	d.meta.Seed = int64(d.uint64())
+	if d.version >= 3 {
+		d.meta.NextID = d.uint64()
+	}
+	d.meta.Gravity = d.string()
+	d.meta.Integrator = d.string()
+	d.n = d.uint64()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if weird(d.meta.G, d.meta.Dt, d.meta.Time) {
+		return nil, errors.New(`NaN or infinite simulation parameter`)
+	}
+
+	return d, nil
+}
+
+func (d *SnapshotDecoder) bytes(b []byte) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = io.ReadFull(d.r, b)
+	if d.err == io.EOF {
+		d.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (d *SnapshotDecoder) uint32() uint32 {
+	d.bytes(d.buf[:4])
+	return binary.LittleEndian.Uint32(d.buf[:4])
+}
+
+func (d *SnapshotDecoder) uint64() uint64 {
+	d.bytes(d.buf[:])
+	return binary.LittleEndian.Uint64(d.buf[:])
+}
+
+func (d *SnapshotDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *SnapshotDecoder) v3() vector.V3 {
+	return vector.V3{X: d.float64(), Y: d.float64(), Z: d.float64()}
+}
+
+func (d *SnapshotDecoder) string() string {
+	l := d.uint32()
+	if d.err != nil {
+		return ""
+	}
+	if l > binaryMaxString {
+		d.err = fmt.Errorf(`string of length %d is too long`, l)
+		return ""
+	}
+
+	b := make([]byte, l)
+	d.bytes(b)
+	return string(b)
+}
+
+// Meta returns the simulation parameters stored in the header.
+func (d *SnapshotDecoder) Meta() SnapshotMeta {
+	return d.meta
+}
+
+// Len returns the number of particles in the snapshot.
+func (d *SnapshotDecoder) Len() int {
+	return int(d.n)
+}
+
+// Next reads and validates the next particle. It returns io.EOF after the
+// last one.
+func (d *SnapshotDecoder) Next() (*Particle, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.read == d.n {
+		return nil, io.EOF
+	}
+
+	p := &Particle{}
+	if d.version >= 3 {
+		p.ID = d.uint64()
+	}
+	p.T = d.float64()
+	p.R = d.float64()
+	p.M = d.float64()
+	p.Pos = d.v3()
+	p.Vel = d.v3()
+
+	l := d.uint32()
+	if d.err == nil && l > binaryMaxTrail {
+		d.err = fmt.Errorf(`particle %d: trail of length %d is too long`, d.read, l)
+	}
+	if d.err == nil && l > 0 {
+		p.Trail = make([]vector.V3, l)
+		for i := range p.Trail {
+			p.Trail[i] = d.v3()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	err := p.validate()
+	if err != nil {
+		d.err = fmt.Errorf(`particle %d: %s`, d.read, err)
+		return nil, d.err
+	}
+	d.read++
+
+	return p, nil
+}
+
+// WriteSnapshotBinary writes the particles of the orrery and the simulation
+// parameters to w in the binary format. The state is copied first, so the
+// simulation isn't blocked while the snapshot is encoded.
+func (o *Orrery) WriteSnapshotBinary(w io.Writer) error {
+	s := o.takeSnapshot()
+
+	e, err := NewSnapshotEncoder(w, s.Meta, len(s.Particles))
+	if err != nil {
+		return err
+	}
+	for _, p := range s.Particles {
+		err = e.Encode(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.Close()
+}
+
+// ReadSnapshotBinary replaces the particles of the orrery with those read
+// from the binary snapshot in r. Nothing is replaced if the snapshot is
+// invalid.
+func (o *Orrery) ReadSnapshotBinary(r io.Reader) error {
+	d, err := NewSnapshotDecoder(r)
+	if err != nil {
+		return err
+	}
+
+	s := snapshot{
+		Version: snapshotVersion,
+		Meta:    d.Meta(),
+	}
+	for {
+		p, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf(`invalid snapshot: %s`, err)
+		}
+		s.Particles = append(s.Particles, p)
+	}
+
+	// Particles are validated while decoding, this catches duplicate IDs
+	err = s.validate()
+	if err != nil {
+		return fmt.Errorf(`invalid snapshot: %s`, err)
+	}
+
+	o.restore(s)
+	return nil
+}
@@ -0,0 +1,151 @@
+package orrery
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func withTrails(ps []*Particle) []*Particle {
+	for _, p := range ps {
+		p.Trail = append(p.Trail, p.Pos, p.Pos.Add(p.Vel))
+	}
+	return ps
+}
+
+func TestSnapshotBinaryRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 23
+	o := New(cfg)
+	defer o.Close()
+
+	o.l.Lock()
+	o.particles = newParticleStore(withTrails(randomParticles(100, 1)))
+	o.l.Unlock()
+	o.Step(3)
+
+	buf := &bytes.Buffer{}
+	err := o.WriteSnapshotBinary(buf)
+	if err != nil {
+		t.Fatalf(`can't write snapshot: %s`, err)
+	}
+
+	on := New(DefaultConfig())
+	defer on.Close()
+	err = on.ReadSnapshotBinary(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf(`can't read snapshot: %s`, err)
+	}
+
+	if on.Ticks() != o.Ticks() || on.Time() != o.Time() {
+		t.Errorf(`expected clock at tick %d, got %d`, o.Ticks(), on.Ticks())
+	}
+
+	ps, psn := o.Particles(), on.Particles()
+	if len(ps) != len(psn) {
+		t.Fatalf(`expected %d particles, got %d`, len(ps), len(psn))
+	}
+	for i := range ps {
+		if ps[i].Pos != psn[i].Pos || ps[i].Vel != psn[i].Vel || ps[i].M != psn[i].M || ps[i].R != psn[i].R {
+			t.Errorf(`particle %d: expected %s, got %s`, i, ps[i], psn[i])
+		}
+		if len(ps[i].Trail) != len(psn[i].Trail) {
+			t.Errorf(`particle %d: expected trail of length %d, got %d`, i, len(ps[i].Trail), len(psn[i].Trail))
+		}
+	}
+
+	// Every truncation of the snapshot has to be rejected
+	for _, l := range []int{0, 3, 20, buf.Len() / 2, buf.Len() - 1} {
+		err = on.ReadSnapshotBinary(bytes.NewReader(buf.Bytes()[:l]))
+		if err == nil {
+			t.Errorf(`expected an error for a snapshot truncated to %d bytes`, l)
+		}
+	}
+	if n := len(on.Particles()); n != len(ps) {
+		t.Errorf(`expected particles to be kept, got %d`, n)
+	}
+}
+
+func TestSnapshotFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orrery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	o.particles = newParticleStore(withTrails(randomParticles(50, 2)))
+	o.l.Unlock()
+
+	for _, name := range []string{"u.json", "u.json.gz", "u.bin", "u.bin.gz"} {
+		fname := filepath.Join(dir, name)
+
+		err := o.SaveSnapshot(fname)
+		if err != nil {
+			t.Errorf(`%s: can't save: %s`, name, err)
+			continue
+		}
+
+		on := New(DefaultConfig())
+		defer on.Close()
+		err = on.LoadSnapshot(fname)
+		if err != nil {
+			t.Errorf(`%s: can't load: %s`, name, err)
+			continue
+		}
+
+		if n := len(on.Particles()); n != 50 {
+			t.Errorf(`%s: expected 50 particles, got %d`, name, n)
+		}
+	}
+
+	// Binary snapshots must not be mistaken for JSON and vice versa
+	err = os.Rename(filepath.Join(dir, "u.bin"), filepath.Join(dir, "bin.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.LoadSnapshot(filepath.Join(dir, "bin.json")); err == nil {
+		t.Errorf(`expected an error for a binary snapshot named .json`)
+	}
+}
+
+func benchmarkSnapshot(b *testing.B, write func(*Orrery, *bytes.Buffer) error) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	ps := randomParticles(10000, 3)
+	for _, p := range ps {
+		p.Trail = make([]vector.V3, o.trailLength)
+	}
+	o.particles = newParticleStore(ps)
+	o.l.Unlock()
+
+	buf := &bytes.Buffer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := write(o, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkSnapshotJSON(b *testing.B) {
+	benchmarkSnapshot(b, func(o *Orrery, buf *bytes.Buffer) error {
+		return o.WriteSnapshot(buf)
+	})
+}
+
+func BenchmarkSnapshotBinary(b *testing.B) {
+	benchmarkSnapshot(b, func(o *Orrery, buf *bytes.Buffer) error {
+		return o.WriteSnapshotBinary(buf)
+	})
+}
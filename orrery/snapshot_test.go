@@ -0,0 +1,262 @@
+package orrery
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 42
+	o := New(cfg)
+	defer o.Close()
+
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+	o.Step(10)
+
+	buf := &bytes.Buffer{}
+	err := o.WriteSnapshot(buf)
+	if err != nil {
+		t.Fatalf(`can't write snapshot: %s`, err)
+	}
+
+	if strings.Contains(buf.String(), `"L"`) {
+		t.Errorf(`snapshot contains particle mutex: %s`, buf.String())
+	}
+
+	on := New(cfg)
+	defer on.Close()
+	err = on.ReadSnapshot(buf)
+	if err != nil {
+		t.Fatalf(`can't read snapshot: %s`, err)
+	}
+
+	if on.Ticks() != 10 || on.Time() != 10 {
+		t.Errorf(`expected clock at tick 10, got tick %d, time %f`, on.Ticks(), on.Time())
+	}
+
+	ps, psn := o.Particles(), on.Particles()
+	if len(ps) != len(psn) {
+		t.Fatalf(`expected %d particles, got %d`, len(ps), len(psn))
+	}
+	for i := range ps {
+		if ps[i].Pos != psn[i].Pos || ps[i].Vel != psn[i].Vel || ps[i].M != psn[i].M {
+			t.Errorf(`particle %d: expected %s, got %s`, i, ps[i], psn[i])
+		}
+	}
+}
+
+func TestSaveSnapshotKeepsOldFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orrery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+
+	fname := filepath.Join(dir, "universe.json")
+	if err := o.SaveSnapshot(fname); err != nil {
+		t.Fatalf(`can't save snapshot: %s`, err)
+	}
+	old, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JSON can't encode NaN, so this save fails halfway through
+	o.l.Lock()
+	o.particles.pos[1].X = math.NaN()
+	o.l.Unlock()
+	if err := o.SaveSnapshot(fname); err == nil {
+		t.Fatalf(`expected saving NaN to fail`)
+	}
+
+	cur, err := ioutil.ReadFile(fname)
+	if err != nil || !bytes.Equal(cur, old) {
+		t.Errorf(`failed save changed the previous snapshot`)
+	}
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Errorf(`expected only the snapshot in %s, got %d files`, dir, len(fis))
+	}
+}
+
+func TestSnapshotMigrateV1(t *testing.T) {
+	v1 := `[{"T":0,"R":1.26,"M":2,"Pos":{"X":1,"Y":2,"Z":3},"Vel":{"X":0,"Y":0,"Z":0},"Trail":null,"L":{}}]`
+
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.ReadSnapshot(strings.NewReader(v1))
+	if err != nil {
+		t.Fatalf(`can't read version 1 snapshot: %s`, err)
+	}
+
+	ps := o.Particles()
+	if len(ps) != 1 || ps[0].Pos != (vector.V3{X: 1, Y: 2, Z: 3}) {
+		t.Errorf(`unexpected particles: %v`, ps)
+	}
+}
+
+func TestSnapshotValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    *Particle
+	}{
+		{"zero mass", &Particle{M: 0, R: 1}},
+		{"negative radius", &Particle{M: 1, R: -1}},
+		{"NaN position", &Particle{M: 1, R: 1, Pos: vector.V3{X: math.NaN()}}},
+		{"infinite velocity", &Particle{M: 1, R: 1, Vel: vector.V3{Y: math.Inf(1)}}},
+	} {
+		s := snapshot{Version: snapshotVersion, Particles: []*Particle{tc.p}}
+		if err := s.validate(); err == nil {
+			t.Errorf(`%s: expected validation error`, tc.name)
+		}
+	}
+
+	// A broken snapshot must leave the orrery untouched
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+
+	err := o.ReadSnapshot(strings.NewReader(`{"Version": 2, "Particles": [{"M": 0, "R": 1}]}`))
+	if err == nil {
+		t.Errorf(`expected an error for a particle without mass`)
+	}
+	if n := len(o.Particles()); n != 2 {
+		t.Errorf(`expected particles to be kept, got %d`, n)
+	}
+}
+
+func TestSnapshotFutureVersion(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.ReadSnapshot(strings.NewReader(`{"Version": 1000, "Particles": []}`))
+	if err == nil {
+		t.Errorf(`expected an error for a snapshot from the future`)
+	}
+}
+
+func TestSnapshotIDs(t *testing.T) {
+	o := New(DefaultConfig())
+	defer o.Close()
+	o.l.Lock()
+	for i := 0; i < 3; i++ {
+		o.addParticle(newParticle(1, vector.V3{X: float64(i) * 10}, vector.V3{}))
+	}
+	o.l.Unlock()
+	o.handleCommand(CommandDelete{ID: 3})
+
+	for _, write := range []func(*Orrery, *bytes.Buffer) error{
+		func(o *Orrery, buf *bytes.Buffer) error { return o.WriteSnapshot(buf) },
+		func(o *Orrery, buf *bytes.Buffer) error { return o.WriteSnapshotBinary(buf) },
+	} {
+		buf := &bytes.Buffer{}
+		err := write(o, buf)
+		if err != nil {
+			t.Fatalf(`can't write snapshot: %s`, err)
+		}
+
+		on := New(DefaultConfig())
+		defer on.Close()
+		if buf.Bytes()[0] == '{' {
+			err = on.ReadSnapshot(buf)
+		} else {
+			err = on.ReadSnapshotBinary(buf)
+		}
+		if err != nil {
+			t.Fatalf(`can't read snapshot: %s`, err)
+		}
+
+		ps := on.Particles()
+		if len(ps) != 2 || ps[0].ID != 1 || ps[1].ID != 2 {
+			t.Errorf(`expected particles 1 and 2, got %v`, ps)
+		}
+
+		// IDs of deleted particles are not handed out again
+		on.handleCommand(CommandSpawnParticle{})
+		ps = on.Particles()
+		if ps[2].ID != 4 {
+			t.Errorf(`expected new particle to get ID 4, got %d`, ps[2].ID)
+		}
+	}
+}
+
+func TestSnapshotMigrateV2(t *testing.T) {
+	v2 := `{"Version":2,"Meta":{"Ticks":5},"Particles":[{"R":1,"M":1},{"R":1,"M":1}]}`
+
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.ReadSnapshot(strings.NewReader(v2))
+	if err != nil {
+		t.Fatalf(`can't read version 2 snapshot: %s`, err)
+	}
+
+	ps := o.Particles()
+	if len(ps) != 2 || ps[0].ID == 0 || ps[1].ID == 0 || ps[0].ID == ps[1].ID {
+		t.Errorf(`expected particles to get distinct IDs, got %v`, ps)
+	}
+}
+
+func TestSnapshotDuplicateIDs(t *testing.T) {
+	dup := `{"Version":3,"Particles":[{"ID":7,"R":1,"M":1},{"ID":7,"R":1,"M":1}]}`
+
+	o := New(DefaultConfig())
+	defer o.Close()
+	err := o.ReadSnapshot(strings.NewReader(dup))
+	if err == nil {
+		t.Errorf(`expected an error for duplicate IDs`)
+	}
+}
+
+func TestSnapshotClearsDiagnostics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DiagnosticsInterval = 10
+	o := New(cfg)
+	defer o.Close()
+	o.l.Lock()
+	o.particles = newParticleStore(twoBody())
+	o.l.Unlock()
+	o.Step(20)
+
+	other := New(cfg)
+	defer other.Close()
+	other.l.Lock()
+	other.particles = newParticleStore(randomParticles(5, 1))
+	other.l.Unlock()
+	buf := &bytes.Buffer{}
+	if err := other.WriteSnapshot(buf); err != nil {
+		t.Fatalf(`can't write snapshot: %s`, err)
+	}
+
+	// Samples of the previous universe are dropped
+	if err := o.ReadSnapshot(buf); err != nil {
+		t.Fatalf(`can't read snapshot: %s`, err)
+	}
+	if h := o.DiagnosticsHistory(); len(h) != 0 {
+		t.Errorf(`expected no samples after loading, got %d`, len(h))
+	}
+	if _, ok := o.LastDiagnostics(); ok {
+		t.Errorf(`expected no last sample after loading`)
+	}
+
+	o.Step(10)
+	h := o.DiagnosticsHistory()
+	if len(h) != 1 || h[0].N != 5 || h[0].Tick != 10 {
+		t.Errorf(`expected one sample of 5 particles at tick 10, got %+v`, h)
+	}
+}
@@ -0,0 +1,61 @@
+package orrery
+
+import (
+	"math"
+	"sort"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// spatialHash is a uniform grid over particle positions. It is used as the
+// broad phase of collision detection so that only particles in neighbouring
+// cells have to be checked against each other.
+type spatialHash struct {
+	cell  float64
+	cells map[[3]int64][]int
+}
+
+func newSpatialHash(pos []vector.V3, cell float64) *spatialHash {
+	if cell <= 0 {
+		cell = 1
+	}
+
+	h := &spatialHash{
+		cell:  cell,
+		cells: make(map[[3]int64][]int),
+	}
+
+	for i, p := range pos {
+		k := h.key(p)
+		h.cells[k] = append(h.cells[k], i)
+	}
+
+	return h
+}
+
+func (h *spatialHash) key(pos vector.V3) [3]int64 {
+	return [3]int64{
+		int64(math.Floor(pos.X / h.cell)),
+		int64(math.Floor(pos.Y / h.cell)),
+		int64(math.Floor(pos.Z / h.cell)),
+	}
+}
+
+// near returns the indices of all particles that may be within r of pos, in
+// ascending order. It may return particles that are further away.
+func (h *spatialHash) near(pos vector.V3, r float64) []int {
+	lo := h.key(vector.V3{X: pos.X - r, Y: pos.Y - r, Z: pos.Z - r})
+	hi := h.key(vector.V3{X: pos.X + r, Y: pos.Y + r, Z: pos.Z + r})
+
+	res := []int{}
+	for x := lo[0]; x <= hi[0]; x++ {
+		for y := lo[1]; y <= hi[1]; y++ {
+			for z := lo[2]; z <= hi[2]; z++ {
+				res = append(res, h.cells[[3]int64{x, y, z}]...)
+			}
+		}
+	}
+	sort.Ints(res)
+
+	return res
+}
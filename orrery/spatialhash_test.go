@@ -0,0 +1,82 @@
+package orrery
+
+import (
+	"testing"
+)
+
+func TestSpatialHashNear(t *testing.T) {
+	ps := randomParticles(500, 4)
+	pos := positions(ps)
+
+	r := 20.0
+	h := newSpatialHash(pos, r)
+
+	for i, p := range pos {
+		found := map[int]bool{}
+		for _, j := range h.near(p, r) {
+			found[j] = true
+		}
+
+		for j, px := range pos {
+			if p.Distance(px) <= r && !found[j] {
+				t.Errorf(`particle %d is within %f of %d but was not found`, j, r, i)
+			}
+		}
+	}
+}
+
+// bruteForceCollisions is handleCollisions without the broad phase.
+func bruteForceCollisions(s *particleStore) {
+	garbage := make([]bool, s.len())
+	for i := 0; i < s.len(); i++ {
+		if garbage[i] {
+			continue
+		}
+		for j := i + 1; j < s.len(); j++ {
+			if garbage[j] {
+				continue
+			}
+			if s.collide(i, j, COLLIDE_MERGE, 0.5) == TOTAL {
+				s.merge(i, j)
+				garbage[j] = true
+			}
+		}
+	}
+
+	s.filter(func(i int) bool { return !garbage[i] })
+}
+
+func TestSpatialHashCollisions(t *testing.T) {
+	// Dense enough that merges chain across cells
+	ps := randomParticles(300, 5)
+	for _, p := range ps {
+		p.Pos = p.Pos.Scaled(0.1)
+	}
+	ref := newParticleStore(ps)
+
+	o := &Orrery{particles: newParticleStore(ps), collisions: COLLIDE_MERGE, restitution: 0.5}
+	o.handleCollisions()
+	bruteForceCollisions(ref)
+
+	if o.particles.len() == len(ps) {
+		t.Errorf(`expected some particles to merge`)
+	}
+	if o.particles.len() != ref.len() {
+		t.Fatalf(`expected %d particles, got %d`, ref.len(), o.particles.len())
+	}
+	for i, m := range o.particles.m {
+		if m != ref.m[i] || o.particles.pos[i] != ref.pos[i] || o.particles.vel[i] != ref.vel[i] {
+			t.Errorf(`particle %d: expected %s, got %s`, i, ref.particle(i), o.particles.particle(i))
+		}
+	}
+}
+
+func BenchmarkCollisions10000(b *testing.B) {
+	ps := randomParticles(10000, 6)
+	o := &Orrery{particles: newParticleStore(ps), collisions: COLLIDE_BOUNCE, restitution: 0.5}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.handleCollisions()
+	}
+}
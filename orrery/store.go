@@ -0,0 +1,248 @@
+package orrery
+
+import (
+	"math"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+// particleStore holds the state of all particles as a struct of arrays, so
+// that the step loop walks through contiguous memory instead of chasing a
+// pointer per particle. Particles are only built from it for the public
+// API. All fields have the same length.
+type particleStore struct {
+	id    []uint64
+	t     []float64 // temperature
+	r     []float64
+	m     []float64
+	pos   []vector.V3
+	vel   []vector.V3
+	trail [][]vector.V3
+
+	dt      []float64 // step size of the last tick, only set by adaptive integrators
+	stepErr []float64 // estimated local position error of the last tick
+
+	endAcc accelCache // accelerations at the end of the last tick, see BlockLeapfrog
+}
+
+// newParticleStore returns a store holding copies of ps.
+func newParticleStore(ps []*Particle) *particleStore {
+	s := &particleStore{}
+	s.set(ps)
+	return s
+}
+
+func (s *particleStore) len() int {
+	return len(s.m)
+}
+
+// add appends a copy of p. The trail is shared with p.
+func (s *particleStore) add(p *Particle) {
+	s.id = append(s.id, p.ID)
+	s.t = append(s.t, p.T)
+	s.r = append(s.r, p.R)
+	s.m = append(s.m, p.M)
+	s.pos = append(s.pos, p.Pos)
+	s.vel = append(s.vel, p.Vel)
+	s.trail = append(s.trail, p.Trail)
+	s.dt = append(s.dt, p.dt)
+	s.stepErr = append(s.stepErr, p.stepErr)
+}
+
+// set replaces the contents of the store with copies of ps.
+func (s *particleStore) set(ps []*Particle) {
+	*s = particleStore{}
+	for _, p := range ps {
+		s.add(p)
+	}
+}
+
+// particle returns a copy of the i-th particle. The trail is copied as well,
+// so the particle can be used without holding the lock of the orrery.
+func (s *particleStore) particle(i int) *Particle {
+	return &Particle{
+		ID:      s.id[i],
+		T:       s.t[i],
+		R:       s.r[i],
+		M:       s.m[i],
+		Pos:     s.pos[i],
+		Vel:     s.vel[i],
+		Trail:   append([]vector.V3{}, s.trail[i]...),
+		dt:      s.dt[i],
+		stepErr: s.stepErr[i],
+	}
+}
+
+// particles returns copies of all particles.
+func (s *particleStore) particles() []*Particle {
+	ps := make([]*Particle, s.len())
+	for i := range ps {
+		ps[i] = s.particle(i)
+	}
+	return ps
+}
+
+// copy returns a deep copy of s.
+func (s *particleStore) copy() *particleStore {
+	n := &particleStore{
+		id:      append([]uint64{}, s.id...),
+		t:       append([]float64{}, s.t...),
+		r:       append([]float64{}, s.r...),
+		m:       append([]float64{}, s.m...),
+		pos:     append([]vector.V3{}, s.pos...),
+		vel:     append([]vector.V3{}, s.vel...),
+		trail:   make([][]vector.V3, s.len()),
+		dt:      append([]float64{}, s.dt...),
+		stepErr: append([]float64{}, s.stepErr...),
+	}
+	for i, t := range s.trail {
+		n.trail[i] = append([]vector.V3{}, t...)
+	}
+	return n
+}
+
+// dynamics returns a copy of the masses, positions and velocities, which is
+// all that is needed to compute diagnostics. The other fields are empty.
+func (s *particleStore) dynamics() *particleStore {
+	return &particleStore{
+		m:   append([]float64{}, s.m...),
+		pos: append([]vector.V3{}, s.pos...),
+		vel: append([]vector.V3{}, s.vel...),
+	}
+}
+
+// filter removes all particles for which keep returns false, keeping the
+// order of the rest.
+func (s *particleStore) filter(keep func(i int) bool) {
+	k := 0
+	for i := 0; i < s.len(); i++ {
+		if !keep(i) {
+			continue
+		}
+		s.id[k] = s.id[i]
+		s.t[k] = s.t[i]
+		s.r[k] = s.r[i]
+		s.m[k] = s.m[i]
+		s.pos[k] = s.pos[i]
+		s.vel[k] = s.vel[i]
+		s.trail[k] = s.trail[i]
+		s.dt[k] = s.dt[i]
+		s.stepErr[k] = s.stepErr[i]
+		k++
+	}
+
+	for i := k; i < s.len(); i++ {
+		// Don't keep removed trails alive
+		s.trail[i] = nil
+	}
+
+	s.id = s.id[:k]
+	s.t = s.t[:k]
+	s.r = s.r[:k]
+	s.m = s.m[:k]
+	s.pos = s.pos[:k]
+	s.vel = s.vel[:k]
+	s.trail = s.trail[:k]
+	s.dt = s.dt[:k]
+	s.stepErr = s.stepErr[:k]
+}
+
+// remove removes the i-th particle.
+func (s *particleStore) remove(i int) {
+	s.filter(func(j int) bool { return j != i })
+}
+
+// updateTrails adds the previous positions prev to the trails of all
+// particles that moved further than their radius from the end of their
+// trail, keeping at most trailLength points.
+//
+// Points within the length of a trail are never written to: trails are only
+// appended to or resliced. Copies of the state can therefore share trails
+// with the store, as long as appending to the copy can't write into the
+// store's backing array.
+func (s *particleStore) updateTrails(prev []vector.V3, trailLength int) {
+	for i, t := range s.trail {
+		if len(t) > 0 && s.pos[i].Distance(t[len(t)-1]) <= s.r[i] {
+			continue
+		}
+
+		t = append(t, prev[i])
+		if len(t) > trailLength {
+			t = t[len(t)-trailLength:]
+		}
+		s.trail[i] = t
+	}
+}
+
+func (s *particleStore) applyForce(i int, f vector.V3, scale float64) {
+	if scale == 0 {
+		// vector.Scaled panics on a zero scale
+		return
+	}
+	s.vel[i] = s.vel[i].Add(f.Scaled(scale / s.m[i]))
+}
+
+// collide checks whether particles i and j overlap and bounces them off each
+// other if they do, with a coefficient of restitution of CR. With
+// COLLIDE_MERGE, totally overlapping particles are left alone so that the
+// caller can merge them.
+func (s *particleStore) collide(i, j int, policy CollisionPolicy, CR float64) collision {
+	if i == j {
+		panic(`can't collide with myself!`)
+	}
+
+	if s.m[i] == 0 || s.m[j] == 0 {
+		panic(`colliding a particle with zero mass!`)
+	}
+
+	d := s.pos[i].Distance(s.pos[j])
+	if d > s.r[i]+s.r[j] {
+		return NONE
+	}
+
+	total := d < math.Max(s.r[i], s.r[j])
+	if total && policy == COLLIDE_MERGE {
+		return TOTAL
+	}
+
+	mi, mj := s.m[i], s.m[j]
+
+	a1 := 2 * mj / (mi + mj)
+	v1 := s.vel[j].Sub(s.vel[i])
+
+	a2 := 2 * mi / (mi + mj)
+	v2 := s.vel[i].Sub(s.vel[j])
+
+	s.applyForce(i, v1.Normalized(), a1*CR)
+	s.applyForce(j, v2.Normalized(), a2*CR)
+
+	s.t[i] += (a1 * (1 - CR)) / mi
+	s.t[j] += (a2 * (1 - CR)) / mj
+
+	if total {
+		return TOTAL
+	}
+
+	return PARTIAL
+}
+
+// merge combines particle j into particle i inelastically, and leaves j
+// alone for the caller to remove. Mass and momentum are conserved, the
+// temperature is the mass-weighted average and the ID and trail are
+// inherited from the heavier of the two.
+func (s *particleStore) merge(i, j int) {
+	mi, mj := s.m[i], s.m[j]
+	m := mi + mj
+
+	s.pos[i] = s.pos[i].Scaled(mi / m).Add(s.pos[j].Scaled(mj / m))
+	s.vel[i] = s.vel[i].Scaled(mi / m).Add(s.vel[j].Scaled(mj / m))
+	s.t[i] = (s.t[i]*mi + s.t[j]*mj) / m
+	s.m[i] = m
+	s.r[i] = math.Pow(m, 1.0/3)
+	s.dt[i], s.stepErr[i] = 0, 0
+
+	if mj > mi {
+		s.id[i] = s.id[j]
+		s.trail[i] = append([]vector.V3{}, s.trail[j]...)
+	}
+}
@@ -0,0 +1,110 @@
+package orrery
+
+import (
+	"math"
+	"testing"
+
+	"git.c3pb.de/farhaven/universe/vector"
+)
+
+func TestStoreFilter(t *testing.T) {
+	s := newParticleStore(randomParticles(10, 1))
+	for i := range s.id {
+		s.id[i] = uint64(i + 1)
+	}
+
+	s.filter(func(i int) bool { return i%3 != 0 })
+	s.remove(0)
+
+	ids := []uint64{3, 5, 6, 8, 9}
+	if s.len() != len(ids) || len(s.pos) != len(ids) || len(s.trail) != len(ids) || len(s.stepErr) != len(ids) {
+		t.Fatalf(`expected %d particles in every field, got %d`, len(ids), s.len())
+	}
+	for i, id := range ids {
+		if s.id[i] != id {
+			t.Errorf(`expected particle %d at index %d, got %d`, id, i, s.id[i])
+		}
+	}
+}
+
+func TestStoreTrails(t *testing.T) {
+	s := newParticleStore([]*Particle{newParticle(1, vector.V3{}, vector.V3{})})
+
+	for x := 1; x <= 5; x++ {
+		prev := append([]vector.V3{}, s.pos...)
+		s.pos[0] = vector.V3{X: float64(x) * 2}
+		s.updateTrails(prev, 3)
+	}
+
+	// Ending up within the radius of the end of the trail doesn't add a
+	// point
+	prev := append([]vector.V3{}, s.pos...)
+	s.pos[0] = vector.V3{X: 8.5}
+	s.updateTrails(prev, 3)
+
+	exp := []vector.V3{{X: 4}, {X: 6}, {X: 8}}
+	if len(s.trail[0]) != len(exp) {
+		t.Fatalf(`expected trail %v, got %v`, exp, s.trail[0])
+	}
+	for i := range exp {
+		if s.trail[0][i] != exp[i] {
+			t.Errorf(`expected trail %v, got %v`, exp, s.trail[0])
+		}
+	}
+
+	// Particles are copies that don't share the trail's backing array
+	p := s.particle(0)
+	p.Trail[0] = vector.V3{}
+	if s.trail[0][0] != exp[0] {
+		t.Errorf(`changing a particle changed the store`)
+	}
+}
+
+func TestStoreInelasticCollision(t *testing.T) {
+	s := newParticleStore([]*Particle{
+		newParticle(1, vector.V3{}, vector.V3{X: 1}),
+		newParticle(1, vector.V3{X: 1.5}, vector.V3{X: -1}),
+	})
+
+	// A coefficient of restitution of 0 turns all of the impulse into heat
+	if c := s.collide(0, 1, COLLIDE_BOUNCE, 0); c != PARTIAL {
+		t.Fatalf(`expected a partial collision, got %v`, c)
+	}
+	if s.vel[0] != (vector.V3{X: 1}) || s.vel[1] != (vector.V3{X: -1}) {
+		t.Errorf(`velocities changed: %s, %s`, s.vel[0], s.vel[1])
+	}
+	if s.t[0] <= 0 || s.t[1] <= 0 {
+		t.Errorf(`expected particles to heat up, got %f and %f`, s.t[0], s.t[1])
+	}
+}
+
+// benchmarkTick measures whole ticks of n particles spread out so that the
+// density is the same for every n.
+func benchmarkTick(b *testing.B, n int) {
+	cfg := DefaultConfig()
+	cfg.Gravity = BarnesHut{Theta: 0.5}
+	cfg.DiagnosticsInterval = 0
+	cfg.RewindLength = 0
+	cfg.Seed = 1
+	o := New(cfg)
+	defer o.Close()
+
+	scale := math.Cbrt(float64(n) / 1000)
+	ps := randomParticles(n, 7)
+	for _, p := range ps {
+		p.Pos = p.Pos.Scaled(scale)
+	}
+
+	o.l.Lock()
+	o.particles = newParticleStore(ps)
+	o.l.Unlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		o.tick()
+	}
+}
+
+func BenchmarkTick1000(b *testing.B)   { benchmarkTick(b, 1000) }
+func BenchmarkTick10000(b *testing.B)  { benchmarkTick(b, 10000) }
+func BenchmarkTick100000(b *testing.B) { benchmarkTick(b, 100000) }
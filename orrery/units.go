@@ -0,0 +1,30 @@
+package orrery
+
+import "math"
+
+// Units is a system of units that positions, masses and times can be given
+// in. It only decides the value of the gravitational constant G; the orrery
+// itself doesn't care about units.
+type Units struct {
+	Name   string
+	Length string
+	Mass   string
+	Time   string
+	G      float64 // gravitational constant in these units
+}
+
+var (
+	// UNITS_SIMULATION are the arbitrary units of the default
+	// configuration, tuned to give interesting orbits on screen.
+	UNITS_SIMULATION = Units{Name: "simulation", G: 0.5}
+	// UNITS_SI are metres, kilograms and seconds.
+	UNITS_SI = Units{Name: "si", Length: "m", Mass: "kg", Time: "s", G: 6.674e-11}
+	// UNITS_SOLAR are astronomical units, solar masses and years. A body
+	// on a circular orbit of 1 AU around one solar mass takes a year.
+	UNITS_SOLAR = Units{Name: "solar", Length: "AU", Mass: "M☉", Time: "yr", G: 4 * math.Pi * math.Pi}
+	// UNITS_GALACTIC are parsecs, solar masses and megayears.
+	UNITS_GALACTIC = Units{Name: "galactic", Length: "pc", Mass: "M☉", Time: "Myr", G: 4.498502151469554e-3}
+)
+
+// UnitSystems lists all known unit systems.
+var UnitSystems = []Units{UNITS_SIMULATION, UNITS_SI, UNITS_SOLAR, UNITS_GALACTIC}
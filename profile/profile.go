@@ -0,0 +1,119 @@
+// Package profile sets up optional CPU, heap and execution tracing profiles
+// as well as a net/http/pprof listener, all controlled by command line flags.
+package profile
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// Options holds the profiling settings. Everything is off by default.
+type Options struct {
+	CPUProfile  string
+	HeapProfile string
+	Trace       string
+	PprofAddr   string // address of the net/http/pprof listener
+}
+
+func (opts *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&opts.CPUProfile, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&opts.HeapProfile, "memprofile", "", "write a heap profile to this file on exit")
+	fs.StringVar(&opts.Trace, "trace", "", "write a runtime trace to this file")
+	fs.StringVar(&opts.PprofAddr, "pprof", "", "serve net/http/pprof on this address, e.g. localhost:6060")
+}
+
+// Start starts all requested profiles. The returned function stops them and
+// writes the heap profile, it has to be called before the program exits.
+func (opts Options) Start() (stop func(), err error) {
+	stops := []func(){}
+	stop = func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if opts.CPUProfile != "" {
+		f, err := os.Create(opts.CPUProfile)
+		if err != nil {
+			return func() {}, fmt.Errorf(`can't create CPU profile: %s`, err)
+		}
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			f.Close()
+			return func() {}, fmt.Errorf(`can't start CPU profile: %s`, err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+
+	if opts.Trace != "" {
+		f, err := os.Create(opts.Trace)
+		if err != nil {
+			stop()
+			return func() {}, fmt.Errorf(`can't create trace: %s`, err)
+		}
+		err = trace.Start(f)
+		if err != nil {
+			f.Close()
+			stop()
+			return func() {}, fmt.Errorf(`can't start trace: %s`, err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+
+	if opts.HeapProfile != "" {
+		fname := opts.HeapProfile
+		stops = append(stops, func() {
+			f, err := os.Create(fname)
+			if err != nil {
+				log.Printf(`can't create heap profile: %s`, err)
+				return
+			}
+			defer f.Close()
+
+			runtime.GC()
+			err = pprof.WriteHeapProfile(f)
+			if err != nil {
+				log.Printf(`can't write heap profile: %s`, err)
+			}
+		})
+	}
+
+	if opts.PprofAddr != "" {
+		host, port, err := net.SplitHostPort(opts.PprofAddr)
+		if err != nil {
+			stop()
+			return func() {}, fmt.Errorf(`invalid pprof address: %s`, err)
+		}
+		if host == "" {
+			// Don't expose the profiler to the network by accident
+			host = "localhost"
+		}
+
+		l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			stop()
+			return func() {}, fmt.Errorf(`can't listen for pprof: %s`, err)
+		}
+		log.Printf(`serving pprof on http://%s/debug/pprof/`, l.Addr())
+		go http.Serve(l, nil)
+		stops = append(stops, func() {
+			l.Close()
+		})
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,232 @@
+// Package slots manages named save slots in a directory. A slot is a
+// snapshot file with an optional PNG thumbnail of the scene next to it.
+package slots
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Extension of newly created slots. Existing slots may have any extension
+// the orrery can load.
+const Extension = ".bin.gz"
+
+var extensions = []string{".json", ".json.gz", ".bin", ".bin.gz"}
+
+// Slot describes a single save slot.
+type Slot struct {
+	Name      string
+	Time      time.Time // when the slot was last written
+	Snapshot  string    // path of the snapshot file
+	Thumbnail string    // path of the thumbnail, empty if there is none
+}
+
+// Store is a directory of save slots.
+type Store struct {
+	Dir string
+}
+
+// slotName returns the name of the slot stored in the file fname, or false
+// if fname isn't a snapshot.
+func slotName(fname string) (string, bool) {
+	for _, ext := range extensions {
+		if strings.HasSuffix(fname, ext) && len(fname) > len(ext) {
+			return strings.TrimSuffix(fname, ext), true
+		}
+	}
+	return "", false
+}
+
+func (s Store) thumbnailPath(name string) string {
+	return filepath.Join(s.Dir, name+".png")
+}
+
+// List returns all slots in the store, the most recent first. A missing
+// directory is an empty store.
+func (s Store) List() ([]Slot, error) {
+	fis, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := []Slot{}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		name, ok := slotName(fi.Name())
+		if !ok {
+			continue
+		}
+
+		sl := Slot{
+			Name:     name,
+			Time:     fi.ModTime(),
+			Snapshot: filepath.Join(s.Dir, fi.Name()),
+		}
+		if _, err := os.Stat(s.thumbnailPath(name)); err == nil {
+			sl.Thumbnail = s.thumbnailPath(name)
+		}
+		res = append(res, sl)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Time.Equal(res[j].Time) {
+			return res[i].Name > res[j].Name
+		}
+		return res[i].Time.After(res[j].Time)
+	})
+
+	return res, nil
+}
+
+// Create makes sure the store directory exists and returns a new slot
+// named after t. The snapshot file is created empty right away, so that
+// slots created in the same second get different names even before they
+// are written. Slots that are never written should be removed with Remove.
+func (s Store) Create(t time.Time) (Slot, error) {
+	err := os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return Slot{}, err
+	}
+
+	base := t.Format("2006-01-02_15-04-05")
+	name := base
+	for i := 2; ; i++ {
+		ok, err := s.reserve(name)
+		if err != nil {
+			return Slot{}, err
+		}
+		if ok {
+			break
+		}
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	return Slot{
+		Name:      name,
+		Time:      t,
+		Snapshot:  filepath.Join(s.Dir, name+Extension),
+		Thumbnail: s.thumbnailPath(name),
+	}, nil
+}
+
+// reserve creates the empty snapshot file of a new slot called name. It
+// returns false if there already is a slot with that name.
+func (s Store) reserve(name string) (bool, error) {
+	for _, ext := range extensions {
+		_, err := os.Stat(filepath.Join(s.Dir, name+ext))
+		if err == nil {
+			return false, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	// O_EXCL makes sure that only one of several concurrent calls gets
+	// the name
+	fh, err := os.OpenFile(filepath.Join(s.Dir, name+Extension), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, fh.Close()
+}
+
+// Remove deletes the snapshot and thumbnail of sl.
+func (s Store) Remove(sl Slot) error {
+	err := os.Remove(sl.Snapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if sl.Thumbnail != "" {
+		err = os.Remove(sl.Thumbnail)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteThumbnail stores img as the thumbnail of sl.
+func WriteThumbnail(sl Slot, img image.Image) error {
+	if sl.Thumbnail == "" {
+		return errors.New(`slot has no thumbnail path`)
+	}
+
+	fh, err := os.Create(sl.Thumbnail)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(fh, img)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
+
+// ReadThumbnail returns the thumbnail of sl.
+func ReadThumbnail(sl Slot) (*image.RGBA, error) {
+	if sl.Thumbnail == "" {
+		return nil, errors.New(`slot has no thumbnail`)
+	}
+
+	fh, err := os.Open(sl.Thumbnail)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	img, err := png.Decode(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scaling to the same size converts the image to RGBA
+	return Scale(img, img.Bounds().Dx()), nil
+}
+
+// Scale returns a copy of img that is width pixels wide, with the same
+// aspect ratio. Pixels are picked by nearest neighbour.
+func Scale(img image.Image, width int) *image.RGBA {
+	b := img.Bounds()
+	if b.Dx() == 0 || width <= 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+
+	height := b.Dy() * width / b.Dx()
+	if height == 0 {
+		height = 1
+	}
+
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := b.Min.Y + y*b.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := b.Min.X + x*b.Dx()/width
+			res.Set(x, y, img.At(sx, sy))
+		}
+	}
+
+	return res
+}
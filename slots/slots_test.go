@@ -0,0 +1,161 @@
+package slots
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempStore(t *testing.T) (Store, func()) {
+	dir, err := ioutil.TempDir("", "slots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Store{Dir: filepath.Join(dir, "saves")}, func() { os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	sl, err := s.List()
+	if err != nil || len(sl) != 0 {
+		t.Fatalf(`expected an empty store, got %v, %v`, sl, err)
+	}
+
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		sl, err := s.Create(t0.Add(time.Duration(i/2) * time.Second))
+		if err != nil {
+			t.Fatalf(`can't create slot: %s`, err)
+		}
+		err = ioutil.WriteFile(sl.Snapshot, []byte(`{}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := t0.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(sl.Snapshot, mtime, mtime)
+
+		if i == 0 {
+			err = WriteThumbnail(sl, image.NewRGBA(image.Rect(0, 0, 4, 3)))
+			if err != nil {
+				t.Fatalf(`can't write thumbnail: %s`, err)
+			}
+		}
+	}
+
+	// Not a slot
+	ioutil.WriteFile(filepath.Join(s.Dir, "notes.txt"), nil, 0644)
+
+	sl, err = s.List()
+	if err != nil {
+		t.Fatalf(`can't list slots: %s`, err)
+	}
+
+	names := []string{}
+	for _, x := range sl {
+		names = append(names, x.Name)
+	}
+	expected := []string{"2020-01-02_03-04-06", "2020-01-02_03-04-05_2", "2020-01-02_03-04-05"}
+	if len(names) != len(expected) {
+		t.Fatalf(`expected slots %v, got %v`, expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf(`expected slots %v, got %v`, expected, names)
+			break
+		}
+	}
+
+	if sl[2].Thumbnail == "" || sl[0].Thumbnail != "" {
+		t.Errorf(`expected only the oldest slot to have a thumbnail: %v`, sl)
+	}
+
+	img, err := ReadThumbnail(sl[2])
+	if err != nil {
+		t.Fatalf(`can't read thumbnail: %s`, err)
+	}
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 3 {
+		t.Errorf(`unexpected thumbnail size %v`, img.Bounds())
+	}
+}
+
+func TestCreateReservesName(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+
+	// Nothing is written to the slots, as if the snapshots were still
+	// being stored
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	names := make(chan string, 10)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			sl, err := s.Create(t0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			names <- sl.Name
+		}()
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-errs:
+			t.Fatalf(`can't create slot: %s`, err)
+		case name := <-names:
+			if seen[name] {
+				t.Errorf(`slot name %s handed out twice`, name)
+			}
+			seen[name] = true
+		}
+	}
+
+	sl, err := s.List()
+	if err != nil || len(sl) != 10 {
+		t.Fatalf(`expected 10 slots, got %d, %v`, len(sl), err)
+	}
+
+	if err := s.Remove(sl[0]); err != nil {
+		t.Fatalf(`can't remove slot: %s`, err)
+	}
+	if sl, _ := s.List(); len(sl) != 9 {
+		t.Errorf(`expected 9 slots after removing one, got %d`, len(sl))
+	}
+}
+
+func TestSlotName(t *testing.T) {
+	for fname, expected := range map[string]string{
+		"a.json":    "a",
+		"a.json.gz": "a",
+		"a.bin":     "a",
+		"a.bin.gz":  "a",
+		"a.gz":      "",
+		"a.png":     "",
+		".bin":      "",
+	} {
+		name, ok := slotName(fname)
+		if ok != (expected != "") || name != expected {
+			t.Errorf(`%s: expected %q, got %q (%v)`, fname, expected, name, ok)
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	img.Set(99, 49, color.RGBA{255, 0, 0, 255})
+
+	s := Scale(img, 10)
+	if s.Bounds().Dx() != 10 || s.Bounds().Dy() != 5 {
+		t.Errorf(`expected 10x5, got %v`, s.Bounds())
+	}
+	if s.RGBAAt(0, 0) != (color.RGBA{}) {
+		t.Errorf(`expected a transparent pixel, got %v`, s.RGBAAt(0, 0))
+	}
+}
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"image"
 	"image/color"
 	"log"
 	"math"
@@ -11,6 +12,7 @@ import (
 	"unsafe"
 
 	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/slots"
 	"git.c3pb.de/farhaven/universe/ui/text"
 	"git.c3pb.de/farhaven/universe/vector"
 
@@ -26,6 +28,12 @@ const (
 	DRAW_FULLSCREEN
 	DRAW_TOGGLE_WIREFRAME
 	DRAW_TOGGLE_VERBOSE
+	DRAW_SAVE_SLOT
+	DRAW_TOGGLE_SLOTS
+	DRAW_CLOSE_SLOTS
+	DRAW_NEXT_SLOT
+	DRAW_PREV_SLOT
+	DRAW_LOAD_SLOT
 )
 
 type DrawContext struct {
@@ -41,14 +49,22 @@ type DrawContext struct {
 	txt      *text.Context
 	shutdown chan struct{}
 
+	slots      slots.Store
+	menu       slotMenu
+	saveQueued bool // store to a new slot after the next frame is drawn
+
+	notices   chan string // messages for the HUD from other goroutines
+	notice    string      // message shown in the HUD until noticeEnd
+	noticeEnd time.Time
+
 	spheresWireframe map[int]uint32
 	spheresSolid     map[int]uint32
 
 	listId uint32 // ID of the next free call list
 }
 
-func NewDrawContext(width, height int, o *orrery.Orrery) DrawContext {
-	txt, err := text.NewContext("font.ttf")
+func NewDrawContext(width, height int, font string, store slots.Store, o *orrery.Orrery) DrawContext {
+	txt, err := text.NewContext(font)
 	if err != nil {
 		log.Fatalf(`can't create text context: %s`, err)
 	}
@@ -96,6 +112,8 @@ func NewDrawContext(width, height int, o *orrery.Orrery) DrawContext {
 			cam:              cam,
 			txt:              txt,
 			shutdown:         make(chan struct{}),
+			slots:            store,
+			notices:          make(chan string, 8),
 			spheresWireframe: make(map[int]uint32),
 			spheresSolid:     make(map[int]uint32),
 		}
@@ -123,16 +141,13 @@ func (ctx *DrawContext) QueueCommand(cmd DrawCommand) {
 	ctx.cmd <- cmd
 }
 
-func (ctx *DrawContext) drawParticles(o *orrery.Orrery) {
-	for _, p := range o.Particles() {
+func (ctx *DrawContext) drawParticles(f *orrery.Frame) {
+	for _, p := range f.Particles {
 		ctx.drawParticle(p)
 	}
 }
 
 func (ctx *DrawContext) drawParticle(p *orrery.Particle) {
-	p.L.Lock()
-	defer p.L.Unlock()
-
 	c := colorful.Hcl(math.Remainder((math.Pi/p.M)*360, 360), 0.9, 0.9)
 
 	ctx.drawSphere(p.Pos, p.R, c)
@@ -225,10 +240,10 @@ func (ctx *DrawContext) drawGrid() {
 	}
 }
 
-func (ctx *DrawContext) createHudTexture(o *orrery.Orrery, frametime time.Duration) (uint32, [2]int, error) {
+func (ctx *DrawContext) createHudTexture(f *orrery.Frame, frametime time.Duration) (uint32, [2]int, error) {
 	lines := []string{}
 
-	if o.Paused {
+	if f.Paused {
 		lines = append(lines, "PAUSED")
 	}
 
@@ -236,27 +251,61 @@ func (ctx *DrawContext) createHudTexture(o *orrery.Orrery, frametime time.Durati
 		lines = append(lines, []string{
 			"WASD: Move, 1: Toggle wireframe, H: Toggle HUD verbosity, Q: Quit",
 			"Mouse Wheel: Move fast, Mouse Btn #1: Spawn particle, V: Spawn 10 particles",
-			"Space: Reset camera, P: Toggle pause",
+			"Mouse Btn #2: Spawn particle orbiting the heaviest one",
+			"Space: Reset camera, P: Toggle pause, [/]: Slower/faster",
+			".: Step one tick while paused, Shift+.: Step 100 ticks",
+			",/Shift+,: Rewind 1/10 frames, //Shift+/: Forward 1/10 frames",
+			"J: Save slots, Shift+J: Save to a new slot",
+			"K: Load the universe file, Shift+K: Store the universe file",
 		}...)
 	}
 
+	lines = append(lines, ctx.slotLines()...)
+	if n := ctx.currentNotice(); n != "" {
+		lines = append(lines, n)
+	}
+
 	lines = append(lines, []string{
 		fmt.Sprintf(` α: %0.2f θ: %0.2f`, ctx.cam.alpha, ctx.cam.theta),
 		fmt.Sprintf(` x: %0.2f y: %0.2f z: %0.2f`, ctx.cam.Pos.X, ctx.cam.Pos.Y, ctx.cam.Pos.Z),
 		fmt.Sprintf(` Last frame time: %s`, frametime),
+		fmt.Sprintf(` t: %0.2f tick: %d speed: %gx`, f.Time, f.Tick, f.TimeScale),
 	}...)
 
+	if f.CanRewind {
+		lines = append(lines, fmt.Sprintf(` rewind: ticks %d to %d`, f.RewindFirst, f.RewindLast))
+	}
+
+	if f.HasDiagnostics {
+		d := f.Diagnostics
+		lines = append(lines, []string{
+			fmt.Sprintf(` E: %.4g (kin %.4g, pot %.4g) drift: %.2g`, d.Energy(), d.Kinetic, d.Potential, d.EnergyDrift),
+			fmt.Sprintf(` p: %s drift: %.2g`, d.Momentum, d.MomentumDrift),
+			fmt.Sprintf(` L: %s drift: %.2g`, d.AngularMomentum, d.AngularMomentumDrift),
+			fmt.Sprintf(` CoM: %s`, d.CentreOfMass),
+		}...)
+	}
+
 	if ctx.verbose {
-		particles := o.Particles()
-		lines = append(lines, fmt.Sprintf(`#P: %d`, len(particles)))
-		for i, p := range particles {
-			p.L.Lock()
-			l := fmt.Sprintf(` π %d: %s`, i, p)
-			p.L.Unlock()
-			lines = append(lines, l)
+		lines = append(lines, fmt.Sprintf(`#P: %d`, len(f.Particles)))
+		for _, p := range f.Particles {
+			lines = append(lines, fmt.Sprintf(` π %s`, p))
 		}
 	}
 
+	bg := color.RGBA{0, 0, 0, 0}
+	fg := color.RGBA{0, 255, 255, 255}
+	img, err := ctx.txt.RenderMultiline(lines, 10.5, bg, fg)
+	if err != nil {
+		return 0, [2]int{0, 0}, err
+	}
+	txt := newTexture(img)
+
+	return txt, [2]int{img.Bounds().Dx(), img.Bounds().Dy()}, nil
+}
+
+// newTexture uploads img to a new texture.
+func newTexture(img *image.RGBA) uint32 {
 	var txt uint32
 	gl.GenTextures(1, &txt)
 
@@ -267,22 +316,35 @@ func (ctx *DrawContext) createHudTexture(o *orrery.Orrery, frametime time.Durati
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_BASE_LEVEL, 0)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAX_LEVEL, 0)
 
-	bg := color.RGBA{0, 0, 0, 0}
-	fg := color.RGBA{0, 255, 255, 255}
-	img, err := ctx.txt.RenderMultiline(lines, 10.5, bg, fg)
-	if err != nil {
-		return 0, [2]int{0, 0}, err
-	}
 	v := reflect.ValueOf(img.Pix)
 	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA,
 		int32(img.Bounds().Dx()), int32(img.Bounds().Dy()),
 		0, gl.RGBA, gl.UNSIGNED_BYTE, unsafe.Pointer(v.Index(0).UnsafeAddr()))
 
-	return txt, [2]int{img.Bounds().Dx(), img.Bounds().Dy()}, nil
+	return txt
 }
 
-func (ctx *DrawContext) drawHud(o *orrery.Orrery, frametime time.Duration) {
-	txt, size, err := ctx.createHudTexture(o, frametime)
+// drawTexture draws the texture txt as a rectangle of the given size with
+// its top left corner at x, y.
+func drawTexture(txt uint32, x, y float32, size [2]int) {
+	w, h := float32(size[0]), float32(size[1])
+
+	gl.BindTexture(gl.TEXTURE_2D, txt)
+	gl.Color3f(1, 1, 1)
+	gl.Begin(gl.QUADS)
+	gl.TexCoord2f(0, 0)
+	gl.Vertex2f(x, y)
+	gl.TexCoord2f(1, 0)
+	gl.Vertex2f(x+w, y)
+	gl.TexCoord2f(1, 1)
+	gl.Vertex2f(x+w, y+h)
+	gl.TexCoord2f(0, 1)
+	gl.Vertex2f(x, y+h)
+	gl.End()
+}
+
+func (ctx *DrawContext) drawHud(f *orrery.Frame, frametime time.Duration) {
+	txt, size, err := ctx.createHudTexture(f, frametime)
 	if err != nil {
 		log.Fatalf(`can't create texture from text surface: %s`, err)
 	}
@@ -296,21 +358,13 @@ func (ctx *DrawContext) drawHud(o *orrery.Orrery, frametime time.Duration) {
 	gl.LoadIdentity()
 	gl.Clear(gl.DEPTH_BUFFER_BIT)
 
-	gl.BindTexture(gl.TEXTURE_2D, txt)
 	gl.Enable(gl.TEXTURE_2D)
 	defer gl.Disable(gl.TEXTURE_2D)
 
-	gl.Color3f(1, 1, 1)
-	gl.Begin(gl.QUADS)
-	gl.TexCoord2f(0, 0)
-	gl.Vertex2f(0.0, 0.0)
-	gl.TexCoord2f(1, 0)
-	gl.Vertex2f(float32(size[0]), 0.0)
-	gl.TexCoord2f(1, 1)
-	gl.Vertex2f(float32(size[0]), float32(size[1]))
-	gl.TexCoord2f(0, 1)
-	gl.Vertex2f(0.0, float32(size[1]))
-	gl.End()
+	drawTexture(txt, 0, 0, size)
+	if ctx.menu.thumb != 0 {
+		drawTexture(ctx.menu.thumb, float32(ctx.width-ctx.menu.thumbSize[0]-10), 10, ctx.menu.thumbSize)
+	}
 
 	gl.PopMatrix()
 }
@@ -342,11 +396,20 @@ func (ctx *DrawContext) drawScreen(o *orrery.Orrery) {
 	for {
 		t_start := time.Now()
 
+		// Everything on screen comes from the same tick
+		f := o.Frame()
+
 		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
 		ctx.cam.Update()
 		ctx.drawGrid()
-		ctx.drawParticles(o)
-		ctx.drawHud(o, t_delta)
+		ctx.drawParticles(f)
+		if ctx.saveQueued {
+			// Before the HUD is drawn, so it doesn't show up in the thumbnail
+			ctx.saveSlot(o)
+			ctx.saveQueued = false
+		}
+		ctx.drawHud(f, t_delta)
+		f.Release()
 		ctx.win.SwapBuffers()
 
 		glfw.PollEvents()
@@ -369,6 +432,22 @@ func (ctx *DrawContext) drawScreen(o *orrery.Orrery) {
 				ctx.wireframe = !ctx.wireframe
 			case DRAW_TOGGLE_VERBOSE:
 				ctx.verbose = !ctx.verbose
+			case DRAW_SAVE_SLOT:
+				ctx.saveQueued = true
+			case DRAW_TOGGLE_SLOTS:
+				if ctx.menu.open {
+					ctx.closeSlots()
+				} else {
+					ctx.openSlots()
+				}
+			case DRAW_CLOSE_SLOTS:
+				ctx.closeSlots()
+			case DRAW_NEXT_SLOT:
+				ctx.selectSlot(1)
+			case DRAW_PREV_SLOT:
+				ctx.selectSlot(-1)
+			case DRAW_LOAD_SLOT:
+				ctx.loadSelectedSlot(o)
 			}
 		default:
 			/* ignore */
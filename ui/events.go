@@ -10,6 +10,28 @@ import (
 	"github.com/go-gl/glfw/v3.1/glfw"
 )
 
+// heaviest returns the ID of the heaviest particle in o.
+func heaviest(o *orrery.Orrery) (uint64, bool) {
+	f := o.Frame()
+	defer f.Release()
+
+	id, m := uint64(0), 0.0
+	for _, p := range f.Particles {
+		if p.M > m {
+			id, m = p.ID, p.M
+		}
+	}
+	return id, m > 0
+}
+
+// queueCommand hands c to o without blocking, so that a busy simulation
+// doesn't stall input handling. The command is dropped if the queue is full.
+func queueCommand(o *orrery.Orrery, c interface{}) {
+	if _, err := o.TryQueueCommand(c); err != nil {
+		log.Printf(`dropping %T: %s`, c, err)
+	}
+}
+
 func (ctx *DrawContext) EventLoop(o *orrery.Orrery, shutdown chan struct{}) {
 	ctx.win.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
 		if action != glfw.Press {
@@ -25,21 +47,59 @@ func (ctx *DrawContext) EventLoop(o *orrery.Orrery, shutdown chan struct{}) {
 		case glfw.KeyH:
 			ctx.QueueCommand(DRAW_TOGGLE_VERBOSE)
 		case glfw.KeyV:
-			o.QueueCommand(orrery.CommandSpawnVolume{Pos: ctx.cam.Pos})
+			queueCommand(o, orrery.CommandSpawnVolume{Pos: ctx.cam.Pos})
 		case glfw.KeyB:
-			o.QueueCommand(orrery.CommandSpawnVolume{Pos: vector.V3{}})
+			queueCommand(o, orrery.CommandSpawnVolume{Pos: vector.V3{}})
 		case glfw.KeyN:
-			o.QueueCommand(orrery.CommandSpawnParticle{Pos: vector.V3{}})
+			queueCommand(o, orrery.CommandSpawnParticle{Pos: vector.V3{}})
 		case glfw.KeySpace:
 			ctx.cam.QueueCommand(cameraCommandReset{})
 		case glfw.KeyP:
-			o.QueueCommand(orrery.CommandPause{})
+			queueCommand(o, orrery.CommandPause{})
+		case glfw.KeyRightBracket:
+			queueCommand(o, orrery.CommandSpeedUp{})
+		case glfw.KeyLeftBracket:
+			queueCommand(o, orrery.CommandSlowDown{})
+		case glfw.KeyPeriod:
+			if mods&glfw.ModShift != 0 {
+				queueCommand(o, orrery.CommandStep{N: 100})
+			} else {
+				queueCommand(o, orrery.CommandStep{N: 1})
+			}
+		case glfw.KeyComma:
+			if mods&glfw.ModShift != 0 {
+				queueCommand(o, orrery.CommandRewind{N: 10})
+			} else {
+				queueCommand(o, orrery.CommandRewind{N: 1})
+			}
+		case glfw.KeySlash:
+			if mods&glfw.ModShift != 0 {
+				queueCommand(o, orrery.CommandRewind{N: -10})
+			} else {
+				queueCommand(o, orrery.CommandRewind{N: -1})
+			}
 		case glfw.KeyJ:
 			if mods&glfw.ModShift != 0 {
-				o.QueueCommand(orrery.CommandStore{})
+				ctx.QueueCommand(DRAW_SAVE_SLOT)
+			} else if mods == 0 {
+				ctx.QueueCommand(DRAW_TOGGLE_SLOTS)
+			}
+		case glfw.KeyK:
+			if mods&glfw.ModShift != 0 {
+				ctx.storeUniverse(o)
 			} else if mods == 0 {
-				o.QueueCommand(orrery.CommandLoad{})
+				ctx.loadUniverse(o)
 			}
+		case glfw.KeyEscape:
+			ctx.QueueCommand(DRAW_CLOSE_SLOTS)
+		case glfw.KeyTab:
+			if mods&glfw.ModShift != 0 {
+				ctx.QueueCommand(DRAW_PREV_SLOT)
+			} else {
+				ctx.QueueCommand(DRAW_NEXT_SLOT)
+			}
+		case glfw.KeyEnter:
+			ctx.QueueCommand(DRAW_LOAD_SLOT)
 		default:
 			log.Printf(`key: key:%v s:%v a:%v m:%v`, key, scancode, action, mods)
 		}
@@ -61,7 +121,11 @@ func (ctx *DrawContext) EventLoop(o *orrery.Orrery, shutdown chan struct{}) {
 			return
 		}
 		if button == 0 {
-			o.QueueCommand(orrery.CommandSpawnParticle{Pos: ctx.cam.Pos})
+			queueCommand(o, orrery.CommandSpawnParticle{Pos: ctx.cam.Pos})
+		} else if button == 1 {
+			if id, ok := heaviest(o); ok {
+				queueCommand(o, orrery.CommandSpawnOrbit{Parent: id, Pos: ctx.cam.Pos})
+			}
 		} else {
 			log.Printf(`mouse btn: button:%v action:%v mod:%v`, button, action, mod)
 		}
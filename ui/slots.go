@@ -0,0 +1,224 @@
+package ui
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"time"
+	"unsafe"
+
+	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/slots"
+
+	"github.com/go-gl/gl/v2.1/gl"
+)
+
+const thumbnailWidth = 240
+
+// How long messages about saving and loading stay in the HUD
+const noticeTime = 5 * time.Second
+
+// slotMenu is the in-app list of save slots. It is only touched from the
+// drawing goroutine.
+type slotMenu struct {
+	open     bool
+	slots    []slots.Slot
+	selected int
+
+	thumb     uint32 // texture of the selected slot's thumbnail, 0 if there is none
+	thumbSize [2]int
+}
+
+func (ctx *DrawContext) openSlots() {
+	sl, err := ctx.slots.List()
+	if err != nil {
+		log.Printf(`can't list save slots: %s`, err)
+	}
+
+	ctx.menu.open = true
+	ctx.menu.slots = sl
+	ctx.menu.selected = 0
+	ctx.loadThumbnail()
+}
+
+func (ctx *DrawContext) closeSlots() {
+	ctx.menu.open = false
+	ctx.menu.slots = nil
+	ctx.loadThumbnail()
+}
+
+// selectSlot moves the selection by d, wrapping around at the ends.
+func (ctx *DrawContext) selectSlot(d int) {
+	n := len(ctx.menu.slots)
+	if !ctx.menu.open || n == 0 {
+		return
+	}
+
+	ctx.menu.selected = ((ctx.menu.selected+d)%n + n) % n
+	ctx.loadThumbnail()
+}
+
+func (ctx *DrawContext) loadSelectedSlot(o *orrery.Orrery) {
+	if !ctx.menu.open || len(ctx.menu.slots) == 0 {
+		return
+	}
+
+	// Waiting for the result must not stall drawing
+	sl := ctx.menu.slots[ctx.menu.selected]
+	go func() {
+		err := o.QueueCommand(orrery.CommandLoad{Path: sl.Snapshot}).Wait()
+		if err != nil {
+			ctx.notify(fmt.Sprintf(`can't load slot %s: %s`, sl.Name, err))
+			return
+		}
+		ctx.notify(fmt.Sprintf(`loaded slot %s`, sl.Name))
+	}()
+	ctx.closeSlots()
+}
+
+// loadThumbnail replaces the thumbnail texture with that of the selected
+// slot.
+func (ctx *DrawContext) loadThumbnail() {
+	if ctx.menu.thumb != 0 {
+		gl.DeleteTextures(1, &ctx.menu.thumb)
+		ctx.menu.thumb = 0
+	}
+
+	if !ctx.menu.open || len(ctx.menu.slots) == 0 {
+		return
+	}
+
+	sl := ctx.menu.slots[ctx.menu.selected]
+	if sl.Thumbnail == "" {
+		return
+	}
+
+	img, err := slots.ReadThumbnail(sl)
+	if err != nil {
+		log.Printf(`can't read thumbnail of %s: %s`, sl.Name, err)
+		return
+	}
+
+	ctx.menu.thumb = newTexture(img)
+	ctx.menu.thumbSize = [2]int{img.Bounds().Dx(), img.Bounds().Dy()}
+}
+
+func (ctx *DrawContext) slotLines() []string {
+	if !ctx.menu.open {
+		return nil
+	}
+
+	lines := []string{"Save slots (Tab/Shift+Tab: Select, Enter: Load, Esc: Close):"}
+	if len(ctx.menu.slots) == 0 {
+		lines = append(lines, fmt.Sprintf(`  no save slots in %s`, ctx.slots.Dir))
+	}
+	for i, sl := range ctx.menu.slots {
+		marker := " "
+		if i == ctx.menu.selected {
+			marker = ">"
+		}
+		lines = append(lines, fmt.Sprintf(` %s %s  %s`, marker, sl.Name, sl.Time.Format("2006-01-02 15:04:05")))
+	}
+
+	return lines
+}
+
+// captureThumbnail returns a downscaled copy of the current frame buffer.
+func (ctx *DrawContext) captureThumbnail() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, ctx.width, ctx.height))
+	gl.ReadPixels(0, 0, int32(ctx.width), int32(ctx.height), gl.RGBA, gl.UNSIGNED_BYTE, unsafe.Pointer(&img.Pix[0]))
+
+	// GL rows start at the bottom
+	for y := 0; y < ctx.height/2; y++ {
+		top := img.Pix[y*img.Stride : (y+1)*img.Stride]
+		bottom := img.Pix[(ctx.height-1-y)*img.Stride : (ctx.height-y)*img.Stride]
+		for i := range top {
+			top[i], bottom[i] = bottom[i], top[i]
+		}
+	}
+
+	return slots.Scale(img, thumbnailWidth)
+}
+
+// saveSlot stores the universe to a new save slot, with the current frame
+// buffer as its thumbnail. The thumbnail is only written once the snapshot
+// has been stored.
+func (ctx *DrawContext) saveSlot(o *orrery.Orrery) {
+	sl, err := ctx.slots.Create(time.Now())
+	if err != nil {
+		ctx.notify(fmt.Sprintf(`can't create save slot: %s`, err))
+		return
+	}
+
+	// The frame buffer can only be read from the drawing goroutine, but
+	// waiting for the result must not stall drawing
+	thumb := ctx.captureThumbnail()
+	go func() {
+		err := o.QueueCommand(orrery.CommandStore{Path: sl.Snapshot}).Wait()
+		if err != nil {
+			ctx.notify(fmt.Sprintf(`can't save slot %s: %s`, sl.Name, err))
+			if err := ctx.slots.Remove(sl); err != nil {
+				log.Printf(`can't remove slot %s: %s`, sl.Name, err)
+			}
+			return
+		}
+
+		err = slots.WriteThumbnail(sl, thumb)
+		if err != nil {
+			ctx.notify(fmt.Sprintf(`can't write thumbnail of %s: %s`, sl.Name, err))
+			return
+		}
+		ctx.notify(fmt.Sprintf(`saved slot %s`, sl.Name))
+	}()
+}
+
+// loadUniverse replaces the universe with the configured universe file.
+func (ctx *DrawContext) loadUniverse(o *orrery.Orrery) {
+	go func() {
+		err := o.QueueCommand(orrery.CommandLoad{}).Wait()
+		if err != nil {
+			ctx.notify(fmt.Sprintf(`can't load the universe file: %s`, err))
+			return
+		}
+		ctx.notify(`loaded the universe file`)
+	}()
+}
+
+// storeUniverse writes the universe to the configured universe file.
+func (ctx *DrawContext) storeUniverse(o *orrery.Orrery) {
+	go func() {
+		err := o.QueueCommand(orrery.CommandStore{}).Wait()
+		if err != nil {
+			ctx.notify(fmt.Sprintf(`can't store the universe file: %s`, err))
+			return
+		}
+		ctx.notify(`stored the universe file`)
+	}()
+}
+
+// notify shows msg in the HUD for a while, and logs it. It can be called
+// from any goroutine.
+func (ctx *DrawContext) notify(msg string) {
+	log.Print(msg)
+
+	select {
+	case ctx.notices <- msg:
+	default:
+		// The HUD is behind, the message is still in the log
+	}
+}
+
+// currentNotice returns the message to show in the HUD, if any. It is only
+// called from the drawing goroutine.
+func (ctx *DrawContext) currentNotice() string {
+	select {
+	case msg := <-ctx.notices:
+		ctx.notice, ctx.noticeEnd = msg, time.Now().Add(noticeTime)
+	default:
+	}
+
+	if time.Now().After(ctx.noticeEnd) {
+		return ""
+	}
+	return ctx.notice
+}
@@ -1,28 +1,69 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
-	"runtime/pprof"
 
+	"git.c3pb.de/farhaven/universe/config"
 	"git.c3pb.de/farhaven/universe/orrery"
+	"git.c3pb.de/farhaven/universe/profile"
+	"git.c3pb.de/farhaven/universe/slots"
 	"git.c3pb.de/farhaven/universe/ui"
+	"git.c3pb.de/farhaven/universe/vector"
 )
 
 func main() {
-	f, err := os.Create("cpuprofile.prof")
+	prof := profile.Options{}
+	prof.RegisterFlags(flag.CommandLine)
+
+	cfg, printConfig, err := config.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf(`can't parse configuration: %s`, err)
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	ocfg, err := cfg.Orrery()
+	if err != nil {
+		log.Fatalf(`invalid configuration: %s`, err)
+	}
+	gen, err := cfg.Generator()
+	if err != nil {
+		log.Fatalf(`invalid configuration: %s`, err)
+	}
+
+	stopProfiling, err := prof.Start()
 	if err != nil {
-		log.Printf(`can't create CPU profile: %s`, err)
+		log.Fatalf(`can't start profiling: %s`, err)
+	}
+	defer stopProfiling()
+
+	o := orrery.New(ocfg)
+
+	if gen != nil {
+		err = o.Generate(gen, cfg.ICSeed, vector.V3{}, vector.V3{})
+		if err != nil {
+			log.Fatalf(`can't generate initial conditions: %s`, err)
+		}
 	}
-	defer f.Close()
-	pprof.StartCPUProfile(f)
-	defer pprof.StopCPUProfile()
 
-	o := orrery.New()
+	if cfg.Record != "" {
+		err = o.StartRecording(cfg.Record, cfg.RecordInterval)
+		if err != nil {
+			log.Fatalf(`can't start recording: %s`, err)
+		}
+	}
 
-	width, height := 1024, 768
-	ctx := ui.NewDrawContext(width, height, o)
+	ctx := ui.NewDrawContext(cfg.Width, cfg.Height, cfg.Font, slots.Store{Dir: cfg.Slots}, o)
 
 	log.Println(`waiting for ui to shut down`)
 	ctx.WaitForShutdown()
+
+	log.Println(`stopping simulation`)
+	if err := o.Close(); err != nil {
+		log.Printf(`can't finish recording: %s`, err)
+	}
 }